@@ -0,0 +1,60 @@
+package pio
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// AskResponse is implemented by the ask packets which declare the packet id of their response.
+// The asking side checks the received response, and the receiving side checks the response before sending it
+type AskResponse interface{
+	PacketBase
+	ResponsePktId()(uint32)
+}
+
+// ResponseTypeError is returned when the response of an ask is not the expected packet type
+type ResponseTypeError struct{
+	// Request is the packet id of the ask
+	Request uint32
+	// Expect describes the expected response, it's the Go type or the packet id
+	Expect string
+	Response PacketBase
+}
+
+func (e *ResponseTypeError)Error()(string){
+	return fmt.Sprintf("pio: unexpected response %T (0x%02x) of packet 0x%02x, expect %s",
+		e.Response, e.Response.PktId(), e.Request, e.Expect)
+}
+
+// checkResponse checks the response with the declared response packet id of the ask packet
+func checkResponse(p PacketBase, res PacketBase)(error){
+	if ar, ok := p.(AskResponse); ok {
+		if pid := ar.ResponsePktId(); res.PktId() != pid {
+			return &ResponseTypeError{
+				Request: p.PktId(),
+				Expect: fmt.Sprintf("packet 0x%02x", pid),
+				Response: res,
+			}
+		}
+	}
+	return nil
+}
+
+// AskT sends the ask packet, and returns the response as Resp.
+// It returns a *ResponseTypeError if the response is not a Resp
+func AskT[Resp PacketBase](ctx context.Context, c *Conn, req PacketBase)(res Resp, err error){
+	var r PacketBase
+	if r, err = c.AskWith(ctx, req); err != nil {
+		return
+	}
+	var ok bool
+	if res, ok = r.(Resp); !ok {
+		err = &ResponseTypeError{
+			Request: req.PktId(),
+			Expect: reflect.TypeOf((*Resp)(nil)).Elem().String(),
+			Response: r,
+		}
+	}
+	return
+}
@@ -0,0 +1,349 @@
+package pio
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+
+	"github.com/kmcsr/go-pio/encoding"
+)
+
+// The authentication of a Conn runs after the secure handshake and before any packet is dispatched.
+// The messages are length prefixed (and sealed if the Conn is encrypted), and start with a kind byte:
+//
+//   0x00  data of the Authenticator
+//   0x01  accept, the peer is authenticated
+//   0x02  reject, followed by the reason string
+//
+// After the Authenticator of a side returned, the side writes accept or reject.
+// The side which rejected closes the Conn after writing the reason.
+
+const (
+	authData   byte = 0x00
+	authAccept byte = 0x01
+	authReject byte = 0x02
+)
+
+// maxAuthMessage is the max size of an authentication message
+const maxAuthMessage = 64 * 1024
+
+// AuthError reports a failed authentication
+type AuthError struct{
+	Reason string
+	// Remote reports whether the peer rejected this side
+	Remote bool
+}
+
+func (e *AuthError)Error()(string){
+	if e.Remote {
+		return "pio: authentication rejected by peer: " + e.Reason
+	}
+	return "pio: authentication failed: " + e.Reason
+}
+
+// Reject returns an error which makes the authentication fail with the reason,
+// the reason is sent to the peer, other errors are reported to the peer as "authentication failed"
+func Reject(reason string)(error){
+	return &AuthError{Reason: reason}
+}
+
+// AuthTransport exchanges the authentication messages with the peer
+type AuthTransport interface{
+	// WriteMessage queues the message, it does not wait the peer reading it
+	WriteMessage(msg []byte)(error)
+	// ReadMessage returns the next message written by the peer,
+	// or an *AuthError if the peer rejected this side
+	ReadMessage()([]byte, error)
+	// ChannelBinding returns a value which is derived from the keys of the secure session,
+	// it's the same on both sides and differs between sessions, or nil if the Conn is not encrypted.
+	// Mixing it into a proof prevents the proof from being relayed into another session
+	ChannelBinding()([]byte)
+}
+
+// Authenticator authenticates the peer when the Conn starts serving.
+// Both peers run their Authenticator at the same time, usually the same kind of Authenticator
+type Authenticator interface{
+	// Authenticate returns the identity of the peer, or an error to reject the peer
+	Authenticate(t AuthTransport)(identity string, err error)
+}
+
+type authTransport struct{
+	c *Conn
+	queue chan []byte
+	werr chan error
+}
+
+var _ AuthTransport = (*authTransport)(nil)
+
+func newAuthTransport(c *Conn)(t *authTransport){
+	t = &authTransport{
+		c: c,
+		queue: make(chan []byte, 8),
+		werr: make(chan error, 1),
+	}
+	go func(){
+		var err error
+		for msg := range t.queue {
+			if err == nil {
+				err = t.c.writeMessage(msg)
+			}
+		}
+		t.werr <- err
+	}()
+	return
+}
+
+func (t *authTransport)send(kind byte, msg []byte){
+	t.queue <- append([]byte{kind}, msg...)
+}
+
+func (t *authTransport)WriteMessage(msg []byte)(error){
+	if len(msg) >= maxAuthMessage {
+		return fmt.Errorf("pio: authentication message is too large (%d bytes)", len(msg))
+	}
+	t.send(authData, msg)
+	return nil
+}
+
+func (t *authTransport)readMessage()(kind byte, msg []byte, err error){
+	// the peer is not authenticated yet, so the length prefix is checked before the message is allocated
+	if msg, err = t.c.readMessage(maxAuthMessage + sealOverhead); err != nil {
+		return
+	}
+	if len(msg) == 0 || len(msg) > maxAuthMessage {
+		return 0, nil, ErrHandshake
+	}
+	kind, msg = msg[0], msg[1:]
+	if kind == authReject {
+		return 0, nil, &AuthError{Reason: (string)(msg), Remote: true}
+	}
+	return
+}
+
+func (t *authTransport)ReadMessage()(msg []byte, err error){
+	var kind byte
+	if kind, msg, err = t.readMessage(); err != nil {
+		return
+	}
+	if kind != authData {
+		return nil, ErrHandshake
+	}
+	return
+}
+
+func (t *authTransport)ChannelBinding()([]byte){
+	if t.c.secure == nil {
+		return nil
+	}
+	return t.c.secure.binding
+}
+
+// drain discards the messages from the peer until the Conn is closed,
+// so the peer which is writing its result will not block on a synchronous stream
+func (t *authTransport)drain(){
+	go func(){
+		for {
+			if _, err := t.c.readFrameMax(maxAuthMessage + sealOverhead); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// flush waits until all messages are written
+func (t *authTransport)flush()(err error){
+	close(t.queue)
+	select {
+	case err = <-t.werr:
+	case <-t.c.ctx.Done():
+		err = t.c.ctx.Err()
+	}
+	return
+}
+
+// writeMessage writes a length prefixed message, and seals it if the Conn is encrypted
+func (c *Conn)writeMessage(msg []byte)(error){
+	if c.secure != nil {
+		msg = c.secure.seal(msg)
+	}
+	return c.w.WriteBytes(msg)
+}
+
+// readMessage reads a message written by writeMessage, which frame is not larger than max
+func (c *Conn)readMessage(max uint32)(msg []byte, err error){
+	if msg, err = c.readFrameMax(max); err != nil {
+		return
+	}
+	if c.secure != nil {
+		return c.secure.open(msg)
+	}
+	return
+}
+
+// authenticate runs the Authenticator, and stores the identity of the peer
+func (c *Conn)authenticate()(err error){
+	t := newAuthTransport(c)
+	identity, err := c.auth.Authenticate(t)
+	if err != nil {
+		var ae *AuthError
+		t.drain()
+		if errors.As(err, &ae) && ae.Remote {
+			t.flush()
+			return
+		}
+		reason := "authentication failed"
+		if ae != nil {
+			reason = ae.Reason
+		}
+		t.send(authReject, ([]byte)(reason))
+		t.flush()
+		return &AuthError{Reason: reason}
+	}
+	t.send(authAccept, nil)
+	var kind byte
+	if kind, _, err = t.readMessage(); err == nil && kind != authAccept {
+		err = ErrHandshake
+	}
+	if er := t.flush(); err == nil {
+		err = er
+	}
+	if err != nil {
+		return
+	}
+	c.identity = identity
+	return
+}
+
+// Identity returns the identity of the peer that the Authenticator returned,
+// it's valid after ServeDone is closed
+func (c *Conn)Identity()(string){
+	return c.identity
+}
+
+// HMACAuth is a mutual challenge-response Authenticator with shared secrets.
+// Each side sends its identity and a random challenge,
+// then proves that it knows the secret by the HMAC-SHA256 of the channel binding of the session,
+// the challenges, its identity and the identity of the peer.
+// The peer which uses the same identity as this side is rejected,
+// so a proof cannot be relayed from another session of this side.
+// The channel binding prevents the relay between two encrypted sessions by a man in the middle,
+// so HMACAuth should be used with WithEncryption if the transport is not trusted
+type HMACAuth struct{
+	// Identity is the identity of this side which is sent to the peer
+	Identity string
+	// Secret is the secret shared with the peer, it's used if Lookup is nil
+	Secret []byte
+	// Lookup returns the secret shared with the peer of the identity, ok is false if the peer is unknown
+	Lookup func(identity string)(secret []byte, ok bool)
+}
+
+var _ Authenticator = (*HMACAuth)(nil)
+
+const hmacChallengeSize = 32
+
+var hmacAuthLabel = []byte("pio hmac auth v3")
+
+// hmacProof returns the proof of the prover, the binding and the identities are length prefixed,
+// so the session and the direction of the proof are bound
+func hmacProof(secret []byte, binding []byte, verifierChallenge, proverChallenge []byte, prover, verifier string)([]byte){
+	h := hmac.New(sha256.New, secret)
+	w := encoding.WrapWriter(h)
+	w.Write(hmacAuthLabel)
+	w.WriteBytes(binding)
+	w.Write(verifierChallenge)
+	w.Write(proverChallenge)
+	w.WriteString(prover)
+	w.WriteString(verifier)
+	return h.Sum(nil)
+}
+
+func (a *HMACAuth)Authenticate(t AuthTransport)(identity string, err error){
+	challenge := make([]byte, hmacChallengeSize)
+	if _, err = rand.Read(challenge); err != nil {
+		return
+	}
+	hello := new(bytes.Buffer)
+	w := encoding.WrapWriter(hello)
+	w.Write(challenge)
+	w.WriteString(a.Identity)
+	if err = t.WriteMessage(hello.Bytes()); err != nil {
+		return
+	}
+
+	var msg []byte
+	if msg, err = t.ReadMessage(); err != nil {
+		return
+	}
+	if len(msg) < hmacChallengeSize {
+		return "", Reject("bad challenge")
+	}
+	peerChallenge := msg[:hmacChallengeSize]
+	if identity, err = encoding.NewSliceReader(msg[hmacChallengeSize:]).ReadString(); err != nil {
+		return "", Reject("bad challenge")
+	}
+	if bytes.Equal(peerChallenge, challenge) {
+		return "", Reject("reflected challenge")
+	}
+	if identity == a.Identity {
+		return "", Reject("peer uses the local identity")
+	}
+	secret, ok := a.Secret, true
+	if a.Lookup != nil {
+		secret, ok = a.Lookup(identity)
+	}
+	if !ok {
+		return "", Reject("unknown identity")
+	}
+	if err = t.WriteMessage(hmacProof(secret, t.ChannelBinding(), peerChallenge, challenge, a.Identity, identity)); err != nil {
+		return
+	}
+
+	if msg, err = t.ReadMessage(); err != nil {
+		return
+	}
+	if !hmac.Equal(msg, hmacProof(secret, t.ChannelBinding(), challenge, peerChallenge, identity, a.Identity)) {
+		return "", Reject("wrong secret")
+	}
+	return
+}
+
+// TokenAuth is an Authenticator which sends a token and verifies the token of the peer.
+// The token is sent as is, so it should only be used with an encrypted Conn (see WithEncryption)
+type TokenAuth struct{
+	// Token is sent to the peer, it can be empty if the peer does not verify it
+	Token string
+	// Verify returns the identity of the peer of the token, a nil Verify accepts any peer with an empty identity
+	Verify func(token string)(identity string, err error)
+}
+
+var _ Authenticator = (*TokenAuth)(nil)
+
+func (a *TokenAuth)Authenticate(t AuthTransport)(identity string, err error){
+	if err = t.WriteMessage(([]byte)(a.Token)); err != nil {
+		return
+	}
+	var msg []byte
+	if msg, err = t.ReadMessage(); err != nil {
+		return
+	}
+	if a.Verify == nil {
+		return "", nil
+	}
+	return a.Verify((string)(msg))
+}
+
+// StaticTokens returns a TokenAuth.Verify function which accepts the tokens of the map, which values are the identities
+func StaticTokens(tokens map[string]string)(func(token string)(string, error)){
+	return func(token string)(identity string, err error){
+		for t, id := range tokens {
+			if subtle.ConstantTimeCompare(([]byte)(t), ([]byte)(token)) == 1 {
+				return id, nil
+			}
+		}
+		return "", Reject("invalid token")
+	}
+}
@@ -0,0 +1,43 @@
+package pio
+
+import (
+	"bytes"
+	"encoding/hex"
+	"hash/crc32"
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksumError reports a received frame which checksum does not match its body
+type ChecksumError struct{
+	// Frame is the received frame, including the checksum
+	Frame []byte
+	Expect, Actual []byte
+}
+
+func (e *ChecksumError)Error()(string){
+	if e.Actual == nil {
+		return "pio: frame is shorter than its checksum"
+	}
+	return "pio: frame checksum mismatch, expect " + hex.EncodeToString(e.Expect) + ", got " + hex.EncodeToString(e.Actual)
+}
+
+// checkFrame verifies the checksum at the end of the frame and returns the body without it
+func (c *Conn)checkFrame(frame []byte)(body []byte, err *ChecksumError){
+	h := c.newHash()
+	n := len(frame) - h.Size()
+	if n < 0 {
+		return nil, &ChecksumError{Frame: frame}
+	}
+	body = frame[:n]
+	h.Write(body)
+	sum := h.Sum(nil)
+	if !bytes.Equal(sum, frame[n:]) {
+		return nil, &ChecksumError{
+			Frame: frame,
+			Expect: frame[n:],
+			Actual: sum,
+		}
+	}
+	return
+}
@@ -0,0 +1,72 @@
+// Command pioc compiles pio schema files.
+//
+// Usage:
+//
+//	pioc [-go out.go] [-json out.json] [-register RegisterPackets] file.pio
+//
+// The -go output declares the struct and packet types of the schema,
+// with their PktId, WriteTo and ParseFrom methods, and an Ask method for the packets which declared a response.
+// The -json output is the machine readable description of the schema for generators of other languages.
+// See package github.com/kmcsr/go-pio/schema for the schema language.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kmcsr/go-pio/schema"
+)
+
+var (
+	goFlag = flag.String("go", "", "the output Go file, default to the schema file name with .go extension")
+	jsonFlag = flag.String("json", "", "the output JSON description file, empty to disable")
+	registerFlag = flag.String("register", "RegisterPackets", "the name of the generated register function, empty to disable")
+)
+
+func main(){
+	flag.Usage = func(){
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: pioc [flags] file.pio")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(flag.Arg(0), *goFlag, *jsonFlag, *registerFlag); err != nil {
+		fmt.Fprintln(os.Stderr, "pioc:", err)
+		os.Exit(1)
+	}
+}
+
+func run(name string, goOut string, jsonOut string, register string)(err error){
+	var src []byte
+	if src, err = os.ReadFile(name); err != nil {
+		return
+	}
+	var f *schema.File
+	if f, err = schema.Parse(name, src); err != nil {
+		return
+	}
+	if goOut == "" {
+		goOut = strings.TrimSuffix(name, ".pio") + ".go"
+	}
+	var out []byte
+	if out, err = f.GenerateGo(register); err != nil {
+		return
+	}
+	if err = os.WriteFile(goOut, out, 0644); err != nil {
+		return
+	}
+	if jsonOut != "" {
+		if out, err = f.JSON(); err != nil {
+			return
+		}
+		if err = os.WriteFile(jsonOut, append(out, '\n'), 0644); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,394 @@
+// Command piogen generates PktId, ParseFrom and WriteTo methods for Go structs.
+//
+// A packet is declared by a `//pio:packet <id>` line in the doc comment of the struct type:
+//
+//	//go:generate go run github.com/kmcsr/go-pio/cmd/piogen
+//
+//	//pio:packet 0x20
+//	type Move struct{
+//		X, Y float64
+//		Tags []string
+//		Target *Vec
+//	}
+//
+// Struct types of the same package which are used by the packets get WriteTo and ParseFrom too,
+// time.Time, time.Duration, big.Int, big.Float, net.IP, netip.Addr, netip.AddrPort and encoding.UUID
+// use the canonical layouts of encoding.WriteTime etc., the same as encoding.Marshal does.
+// Other types from other packages must implement encoding.Marshaler and encoding.Unmarshaler themselves.
+// Pointer fields are optional values which are prefixed with a presence byte.
+// The `pio:"-"` tag skips a field, `pio:"varint"` encodes an integer field as varint,
+// `pio:"packed"` packs a []bool field with 8 bools per byte,
+// and `pio:"message"` wraps a struct field in a length prefixed message.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kmcsr/go-pio/internal/gen"
+)
+
+const directive = "//pio:packet"
+
+var (
+	dirFlag = flag.String("dir", ".", "the package directory")
+	outFlag = flag.String("o", "pio_gen.go", "the output file name, relative to the package directory")
+	registerFlag = flag.String("register", "RegisterPackets", "the name of the generated register function, empty to disable")
+)
+
+func main(){
+	flag.Parse()
+	if err := run(*dirFlag, *outFlag, *registerFlag); err != nil {
+		fmt.Fprintln(os.Stderr, "piogen:", err)
+		os.Exit(1)
+	}
+}
+
+func run(dir string, out string, register string)(err error){
+	if !filepath.IsAbs(out) {
+		out = filepath.Join(dir, out)
+	}
+	var file *gen.File
+	if file, err = load(dir, out); err != nil {
+		return
+	}
+	file.Register = register
+	var src []byte
+	if src, err = gen.Generate(file); err != nil {
+		return
+	}
+	return os.WriteFile(out, src, 0644)
+}
+
+type loader struct{
+	fset *token.FileSet
+	types map[string]*ast.TypeSpec
+	docs map[string]*ast.CommentGroup
+	// imports maps the type names to the imports of their files, see fileImports
+	imports map[string]map[string]string
+	methods map[string]bool
+	decls map[string]*gen.Decl
+	order []*gen.Decl
+}
+
+func load(dir string, out string)(file *gen.File, err error){
+	l := &loader{
+		fset: token.NewFileSet(),
+		types: make(map[string]*ast.TypeSpec),
+		docs: make(map[string]*ast.CommentGroup),
+		imports: make(map[string]map[string]string),
+		methods: make(map[string]bool),
+		decls: make(map[string]*gen.Decl),
+	}
+	var names []string
+	if names, err = filepath.Glob(filepath.Join(dir, "*.go")); err != nil {
+		return
+	}
+	sort.Strings(names)
+	var pkg string
+	for _, name := range names {
+		if strings.HasSuffix(name, "_test.go") || filepath.Clean(name) == filepath.Clean(out) {
+			continue
+		}
+		var f *ast.File
+		if f, err = parser.ParseFile(l.fset, name, nil, parser.ParseComments); err != nil {
+			return
+		}
+		if pkg == "" {
+			pkg = f.Name.Name
+		}else if pkg != f.Name.Name {
+			return nil, fmt.Errorf("multiple packages %s and %s in %s", pkg, f.Name.Name, dir)
+		}
+		l.collect(f)
+	}
+	if pkg == "" {
+		return nil, fmt.Errorf("no go files in %s", dir)
+	}
+
+	var packets []string
+	for name, doc := range l.docs {
+		if doc == nil {
+			continue
+		}
+		for _, c := range doc.List {
+			if !strings.HasPrefix(c.Text, directive) {
+				continue
+			}
+			var id uint64
+			if id, err = strconv.ParseUint(strings.TrimSpace(c.Text[len(directive):]), 0, 32); err != nil {
+				return nil, fmt.Errorf("%s: bad packet id: %w", l.fset.Position(c.Pos()), err)
+			}
+			var d *gen.Decl
+			if d, err = l.decl(name); err != nil {
+				return
+			}
+			d.IsPacket = true
+			d.PktId = (uint32)(id)
+			packets = append(packets, name)
+		}
+	}
+	if len(packets) == 0 {
+		return nil, fmt.Errorf("no %s declaration in %s", directive, dir)
+	}
+	sort.Slice(l.order, func(i, j int)(bool){ return l.order[i].Name < l.order[j].Name })
+	file = &gen.File{
+		Package: pkg,
+		Generator: "piogen",
+		Decls: l.order,
+	}
+	return
+}
+
+// fileImports maps the package names of the imports of f to their import paths
+func fileImports(f *ast.File)(imports map[string]string){
+	imports = make(map[string]string, len(f.Imports))
+	for _, im := range f.Imports {
+		p, err := strconv.Unquote(im.Path.Value)
+		if err != nil {
+			continue
+		}
+		if im.Name != nil {
+			imports[im.Name.Name] = p
+		}else{
+			// the package name is not known without loading the package, guess it from the path
+			name := path.Base(p)
+			if i := strings.LastIndexByte(name, '.'); i > 0 {
+				name = name[:i]
+			}
+			imports[strings.TrimPrefix(name, "go-")] = p
+		}
+	}
+	return
+}
+
+func (l *loader)collect(f *ast.File){
+	imports := fileImports(f)
+	for _, d := range f.Decls {
+		switch d := d.(type) {
+		case *ast.GenDecl:
+			if d.Tok != token.TYPE {
+				continue
+			}
+			for _, s := range d.Specs {
+				ts := s.(*ast.TypeSpec)
+				l.types[ts.Name.Name] = ts
+				l.imports[ts.Name.Name] = imports
+				doc := ts.Doc
+				if doc == nil && len(d.Specs) == 1 {
+					doc = d.Doc
+				}
+				l.docs[ts.Name.Name] = doc
+			}
+		case *ast.FuncDecl:
+			if d.Recv == nil || len(d.Recv.List) == 0 {
+				continue
+			}
+			recv := d.Recv.List[0].Type
+			if star, ok := recv.(*ast.StarExpr); ok {
+				recv = star.X
+			}
+			if id, ok := recv.(*ast.Ident); ok && (d.Name.Name == "WriteTo" || d.Name.Name == "ParseFrom") {
+				l.methods[id.Name] = true
+			}
+		}
+	}
+}
+
+// decl returns the generated declaration of the struct type, and loads it if it's not loaded yet
+func (l *loader)decl(name string)(d *gen.Decl, err error){
+	if d, ok := l.decls[name]; ok {
+		return d, nil
+	}
+	ts := l.types[name]
+	st, ok := ts.Type.(*ast.StructType)
+	if !ok {
+		return nil, fmt.Errorf("%s: %s is not a struct", l.fset.Position(ts.Pos()), name)
+	}
+	if ts.TypeParams != nil {
+		return nil, fmt.Errorf("%s: generic type %s is not supported", l.fset.Position(ts.Pos()), name)
+	}
+	d = &gen.Decl{
+		Name: name,
+	}
+	l.decls[name] = d
+	l.order = append(l.order, d)
+	for _, f := range st.Fields.List {
+		tag := fieldTag(f)
+		if tag == "-" {
+			continue
+		}
+		var t *gen.Type
+		if t, err = l.resolve(f.Type, l.imports[name]); err != nil {
+			return
+		}
+		switch tag {
+		case "":
+		case "varint":
+			if t.Kind < gen.Uint8 || t.Kind > gen.Int64 {
+				return nil, fmt.Errorf("%s: varint option is not supported by %s", l.fset.Position(f.Pos()), t.GoType)
+			}
+			t.Varint = true
+		case "packed":
+			if t.GoType != "[]bool" {
+				return nil, fmt.Errorf("%s: packed option is not supported by %s", l.fset.Position(f.Pos()), t.GoType)
+			}
+			t.Packed = true
+		case "message":
+			if t.Kind != gen.Struct {
+				return nil, fmt.Errorf("%s: message option is not supported by %s", l.fset.Position(f.Pos()), t.GoType)
+			}
+			t.Message = true
+		default:
+			return nil, fmt.Errorf("%s: pio tag %q is not supported by piogen", l.fset.Position(f.Pos()), tag)
+		}
+		if len(f.Names) == 0 {
+			return nil, fmt.Errorf("%s: embedded field is not supported", l.fset.Position(f.Pos()))
+		}
+		for _, n := range f.Names {
+			if !n.IsExported() {
+				continue
+			}
+			d.Fields = append(d.Fields, gen.Field{
+				Name: n.Name,
+				Type: t,
+			})
+		}
+	}
+	return
+}
+
+func fieldTag(f *ast.Field)(string){
+	if f.Tag == nil {
+		return ""
+	}
+	tag, err := strconv.Unquote(f.Tag.Value)
+	if err != nil {
+		return ""
+	}
+	return reflect.StructTag(tag).Get("pio")
+}
+
+var basicKinds = map[string]gen.Kind{
+	"bool": gen.Bool,
+	"byte": gen.Uint8,
+	"uint8": gen.Uint8,
+	"int8": gen.Int8,
+	"uint16": gen.Uint16,
+	"int16": gen.Int16,
+	"uint32": gen.Uint32,
+	"int32": gen.Int32,
+	"rune": gen.Int32,
+	"uint64": gen.Uint64,
+	"int64": gen.Int64,
+	"uint": gen.Uint64,
+	"int": gen.Int64,
+	"float32": gen.Float32,
+	"float64": gen.Float64,
+	"string": gen.String,
+}
+
+// stdTypes are the types from other packages which have the canonical layouts in encoding,
+// the keys are the import paths and the type names
+var stdTypes = map[[2]string]gen.Type{
+	{"time", "Time"}: {Kind: gen.Std, Std: "Time"},
+	{"time", "Duration"}: {Kind: gen.Int64},
+	{"math/big", "Int"}: {Kind: gen.Std, Std: "BigInt"},
+	{"math/big", "Float"}: {Kind: gen.Std, Std: "BigFloat"},
+	{"net", "IP"}: {Kind: gen.Std, Std: "IP"},
+	{"net/netip", "Addr"}: {Kind: gen.Std, Std: "Addr"},
+	{"net/netip", "AddrPort"}: {Kind: gen.Std, Std: "AddrPort"},
+	{"github.com/kmcsr/go-pio/encoding", "UUID"}: {Kind: gen.Std, Std: "UUID"},
+}
+
+// resolve returns the generated type of expr, imports are the imports of the file where expr is
+func (l *loader)resolve(expr ast.Expr, imports map[string]string)(t *gen.Type, err error){
+	goType := types.ExprString(expr)
+	switch e := expr.(type) {
+	case *ast.Ident:
+		if k, ok := basicKinds[e.Name]; ok {
+			return &gen.Type{Kind: k, GoType: goType}, nil
+		}
+		ts, ok := l.types[e.Name]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown type %s", l.fset.Position(e.Pos()), e.Name)
+		}
+		if _, ok := ts.Type.(*ast.StructType); ok {
+			if !l.methods[e.Name] {
+				if _, err = l.decl(e.Name); err != nil {
+					return
+				}
+			}
+			return &gen.Type{Kind: gen.Struct, GoType: goType}, nil
+		}
+		if l.methods[e.Name] {
+			return &gen.Type{Kind: gen.Struct, GoType: goType}, nil
+		}
+		// a defined non-struct type, encode it as its underlying type
+		if t, err = l.resolve(ts.Type, l.imports[e.Name]); err != nil {
+			return
+		}
+		if t.Kind == gen.Std {
+			return nil, fmt.Errorf("%s: defined type %s of %s is not supported", l.fset.Position(e.Pos()), e.Name, t.GoType)
+		}
+		t.GoType = goType
+		t.Import = ""
+		return
+	case *ast.SelectorExpr:
+		x, ok := e.X.(*ast.Ident)
+		if !ok {
+			break
+		}
+		p, ok := imports[x.Name]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown package %s", l.fset.Position(e.Pos()), x.Name)
+		}
+		t = &gen.Type{Kind: gen.Struct}
+		if std, ok := stdTypes[[2]string{p, e.Sel.Name}]; ok {
+			*t = std
+		}
+		t.GoType = goType
+		t.Import = strconv.Quote(p)
+		if path.Base(p) != x.Name {
+			t.Import = x.Name + " " + t.Import
+		}
+		return
+	case *ast.StarExpr:
+		var elem *gen.Type
+		if elem, err = l.resolve(e.X, imports); err != nil {
+			return
+		}
+		return &gen.Type{Kind: gen.Pointer, GoType: goType, Elem: elem}, nil
+	case *ast.ArrayType:
+		var elem *gen.Type
+		if elem, err = l.resolve(e.Elt, imports); err != nil {
+			return
+		}
+		if e.Len == nil {
+			return &gen.Type{Kind: gen.Slice, GoType: goType, Elem: elem}, nil
+		}
+		return &gen.Type{Kind: gen.Array, GoType: goType, Elem: elem}, nil
+	case *ast.MapType:
+		var key, elem *gen.Type
+		if key, err = l.resolve(e.Key, imports); err != nil {
+			return
+		}
+		if elem, err = l.resolve(e.Value, imports); err != nil {
+			return
+		}
+		return &gen.Type{Kind: gen.Map, GoType: goType, Key: key, Elem: elem}, nil
+	case *ast.ParenExpr:
+		return l.resolve(e.X, imports)
+	}
+	return nil, fmt.Errorf("%s: unsupported type %s", l.fset.Position(expr.Pos()), goType)
+}
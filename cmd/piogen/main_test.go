@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// copyFixture copies the fixture package into a new module which uses this repository
+func copyFixture(t *testing.T)(dir string){
+	root, err := filepath.Abs(filepath.Join("..", ".."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir = t.TempDir()
+	names, err := filepath.Glob(filepath.Join("testdata", "fixture", "*.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(filepath.Join(dir, filepath.Base(name)), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mod := "module fixture\n\ngo 1.20\n\nrequire github.com/kmcsr/go-pio v0.0.0\n\nreplace github.com/kmcsr/go-pio => " + root + "\n"
+	if err = os.WriteFile(filepath.Join(dir, "go.mod"), ([]byte)(mod), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestGenerate(t *testing.T){
+	if testing.Short() {
+		t.Skip("compiles the generated code")
+	}
+	dir := copyFixture(t)
+	if err := run(dir, "pio_gen.go", "RegisterPackets"); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	cmd := exec.Command("go", "test", "-count=1", ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOWORK=off", "GOFLAGS=-mod=mod")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go test of the generated code: %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,25 @@
+package fixture
+
+import (
+	mathbig "math/big"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/kmcsr/go-pio/encoding"
+)
+
+//pio:packet 0x41
+type Stamp struct{
+	At time.Time
+	Wait time.Duration
+	Timeout time.Duration `pio:"varint"`
+	Big mathbig.Int
+	Ratio *mathbig.Float
+	Host net.IP
+	Addr netip.Addr
+	Peer netip.AddrPort
+	Id encoding.UUID
+	Times []time.Time
+	Sums map[string]*mathbig.Int
+}
@@ -0,0 +1,29 @@
+package fixture
+
+type Vec struct{
+	X, Y float64
+}
+
+//pio:packet 0x40
+type Path struct{
+	Name string
+	Points []Vec
+	Tags map[string]uint32
+	Grid [2][3]int16
+	Target *Vec
+	Raw []byte
+	Lines [][]string
+	Count uint64 `pio:"varint"`
+	Delta int32 `pio:"varint"`
+	Flags []bool `pio:"packed"`
+	In Vec `pio:"message"`
+	Skip int `pio:"-"`
+}
+
+type Level int8
+
+//pio:packet 0x42
+type Narrow struct{
+	N Level `pio:"varint"`
+	U uint16 `pio:"varint"`
+}
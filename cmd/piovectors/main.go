@@ -0,0 +1,127 @@
+// Command piovectors writes the wire format test vectors, and verifies pio implementations with them.
+//
+// Usage:
+//
+//	piovectors -o dir                              write vectors.json and the .bin files into dir
+//	piovectors -verify [-encoding le] command ...  run the command and verify the peer on its stdin and stdout
+//	piovectors -peer [-encoding le]                serve a go-pio Conn on stdin and stdout, for testing the verifier
+//
+// The encodings are "le" (little endian, uint32 lengths), "be" (big endian, uint32 lengths)
+// and "le-varlen" (little endian, varint lengths).
+// See package github.com/kmcsr/go-pio/vectors for the wire format and what the peer must do.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/kmcsr/go-pio"
+	"github.com/kmcsr/go-pio/vectors"
+)
+
+var (
+	outFlag = flag.String("o", "", "the directory to write the vectors into")
+	verifyFlag = flag.Bool("verify", false, "run the command in the arguments and verify it")
+	peerFlag = flag.Bool("peer", false, "serve as the reference peer on stdin and stdout")
+	encodingFlag = flag.String("encoding", "le", "the encoding to verify or serve with")
+	timeoutFlag = flag.Duration("timeout", 10 * time.Second, "the timeout of the verification")
+)
+
+func main(){
+	flag.Parse()
+	var err error
+	switch {
+	case *verifyFlag:
+		err = verify(flag.Args())
+	case *peerFlag:
+		err = peer()
+	case *outFlag != "":
+		err = vectors.WriteFiles(*outFlag)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "piovectors:", err)
+		os.Exit(1)
+	}
+}
+
+func lookupEncoding(name string)(vectors.Encoding, error){
+	for _, e := range vectors.Encodings {
+		if e.Name == name {
+			return e.Encoding, nil
+		}
+	}
+	return vectors.Encoding{}, fmt.Errorf("unknown encoding %q", name)
+}
+
+type cmdPipe struct{
+	io.Reader
+	io.Writer
+}
+
+func verify(args []string)(err error){
+	if len(args) == 0 {
+		return fmt.Errorf("no command to verify")
+	}
+	var enc vectors.Encoding
+	if enc, err = lookupEncoding(*encodingFlag); err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeoutFlag)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	var (
+		stdin io.WriteCloser
+		stdout io.ReadCloser
+	)
+	if stdin, err = cmd.StdinPipe(); err != nil {
+		return
+	}
+	if stdout, err = cmd.StdoutPipe(); err != nil {
+		return
+	}
+	if err = cmd.Start(); err != nil {
+		return
+	}
+	err = vectors.Verify(cmdPipe{stdout, stdin}, enc)
+	stdin.Close()
+	cmd.Process.Kill()
+	cmd.Wait()
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w (%v)", err, ctx.Err())
+		}
+		return
+	}
+	fmt.Println("ok")
+	return nil
+}
+
+func peer()(err error){
+	var enc vectors.Encoding
+	if enc, err = lookupEncoding(*encodingFlag); err != nil {
+		return
+	}
+	c := pio.NewConn(os.Stdin, os.Stdout, pio.WithEncoding(enc.Options()...))
+	go c.Serve()
+	<-c.ServeDone()
+	select {
+	case <-c.StreamedDone():
+	case <-c.Context().Done():
+		return c.Context().Err()
+	}
+	var rw io.ReadWriteCloser
+	if rw, err = c.AsStream(); err != nil {
+		return
+	}
+	_, err = io.Copy(rw, rw)
+	return
+}
@@ -0,0 +1,156 @@
+package pio
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kmcsr/go-pio/encoding"
+)
+
+// ErrUnexpectedCompressed is returned by the parser when a compressed frame is received but the Conn has no compressor
+var ErrUnexpectedCompressed = errors.New("pio: received a compressed frame without compression enabled")
+
+// Compressed is the flag bit of the ask byte, which marks that the payload of the frame is compressed
+const Compressed byte = 0x80
+
+// DefaultMaxDecompressed is the max size of a decompressed payload when the MaxFrameSize limit is not set,
+// so a small compressed frame cannot expand to an unbounded size
+const DefaultMaxDecompressed = 16 * 1024 * 1024
+
+// Compressor compresses the payloads of the frames
+type Compressor interface{
+	Compress(src []byte)([]byte, error)
+	// Decompress must fail with an *encoding.LimitError if the result is larger than max, a zero max means no limit
+	Decompress(src []byte, max int64)([]byte, error)
+}
+
+// FlateCompressor is a Compressor which uses compress/flate
+type FlateCompressor struct{
+	level int
+	writers sync.Pool
+}
+
+var _ Compressor = (*FlateCompressor)(nil)
+
+// NewFlateCompressor returns a FlateCompressor with the compression level, see flate.NewWriter
+func NewFlateCompressor(level int)(*FlateCompressor){
+	if _, err := flate.NewWriter(io.Discard, level); err != nil {
+		panic(err)
+	}
+	return &FlateCompressor{
+		level: level,
+	}
+}
+
+func (f *FlateCompressor)Compress(src []byte)(dst []byte, err error){
+	buf := bytes.NewBuffer(make([]byte, 0, len(src) / 2))
+	fw, _ := f.writers.Get().(*flate.Writer)
+	if fw == nil {
+		fw, _ = flate.NewWriter(buf, f.level)
+	}else{
+		fw.Reset(buf)
+	}
+	defer f.writers.Put(fw)
+	if _, err = fw.Write(src); err != nil {
+		return
+	}
+	if err = fw.Close(); err != nil {
+		return
+	}
+	return buf.Bytes(), nil
+}
+
+func (f *FlateCompressor)Decompress(src []byte, max int64)(dst []byte, err error){
+	fr := flate.NewReader(bytes.NewReader(src))
+	defer fr.Close()
+	var rd io.Reader = fr
+	if max > 0 {
+		rd = io.LimitReader(fr, max + 1)
+	}
+	if dst, err = io.ReadAll(rd); err != nil {
+		return nil, err
+	}
+	if max > 0 && (int64)(len(dst)) > max {
+		return nil, &encoding.LimitError{Limit: "MaxFrameSize", Max: max, Size: (int64)(len(dst))}
+	}
+	return
+}
+
+// CompressionStats counts the compressed frames of a Conn
+type CompressionStats struct{
+	// SentFrames is the number of the sent frames which are compressed
+	SentFrames uint64
+	// SentRaw and SentCompressed are the payload sizes of the compressed sent frames, before and after compressing
+	SentRaw, SentCompressed uint64
+	// RecvFrames is the number of the received frames which are compressed
+	RecvFrames uint64
+	// RecvRaw and RecvCompressed are the payload sizes of the compressed received frames, after and before decompressing
+	RecvRaw, RecvCompressed uint64
+}
+
+// SentSaved returns the bytes that the compression saved when sending
+func (s CompressionStats)SentSaved()(uint64){
+	return s.SentRaw - s.SentCompressed
+}
+
+// RecvSaved returns the bytes that the compression saved when receiving
+func (s CompressionStats)RecvSaved()(uint64){
+	return s.RecvRaw - s.RecvCompressed
+}
+
+// CompressionStats returns the statistics of the compressed frames
+func (c *Conn)CompressionStats()(s CompressionStats){
+	if c.compStats == nil {
+		return
+	}
+	return CompressionStats{
+		SentFrames: atomic.LoadUint64(&c.compStats.SentFrames),
+		SentRaw: atomic.LoadUint64(&c.compStats.SentRaw),
+		SentCompressed: atomic.LoadUint64(&c.compStats.SentCompressed),
+		RecvFrames: atomic.LoadUint64(&c.compStats.RecvFrames),
+		RecvRaw: atomic.LoadUint64(&c.compStats.RecvRaw),
+		RecvCompressed: atomic.LoadUint64(&c.compStats.RecvCompressed),
+	}
+}
+
+// compressBody compresses the payload of the frame body if it's large enough and the result is smaller
+func (c *Conn)compressBody(body []byte)([]byte, error){
+	payload := body[frameHeaderSize:]
+	if len(payload) < c.compressMin {
+		return body, nil
+	}
+	comp, err := c.compressor.Compress(payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(comp) >= len(payload) {
+		return body, nil
+	}
+	atomic.AddUint64(&c.compStats.SentFrames, 1)
+	atomic.AddUint64(&c.compStats.SentRaw, (uint64)(len(payload)))
+	atomic.AddUint64(&c.compStats.SentCompressed, (uint64)(len(comp)))
+	body = append(body[:frameHeaderSize], comp...)
+	body[4] |= Compressed
+	return body, nil
+}
+
+func (c *Conn)decompressPayload(payload []byte)(raw []byte, err error){
+	if c.compressor == nil {
+		return nil, ErrUnexpectedCompressed
+	}
+	max := (int64)(c.limits.MaxFrameSize)
+	if max == 0 {
+		max = DefaultMaxDecompressed
+	}
+	if raw, err = c.compressor.Decompress(payload, max); err != nil {
+		return
+	}
+	atomic.AddUint64(&c.compStats.RecvFrames, 1)
+	atomic.AddUint64(&c.compStats.RecvRaw, (uint64)(len(raw)))
+	atomic.AddUint64(&c.compStats.RecvCompressed, (uint64)(len(payload)))
+	return
+}
@@ -5,6 +5,8 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"os"
 	"sync"
@@ -20,6 +22,9 @@ const (
 	RecvAsk byte = 0x02
 )
 
+// frameHeaderSize is the size of the id, the ask byte and the packet id at the beginning of a frame body
+const frameHeaderSize = 4 + 1 + 4
+
 type ConnState int
 const (
 	ConnInited ConnState = iota
@@ -31,11 +36,30 @@ const (
 type Conn struct{
 	r encoding.Reader
 	w encoding.Writer
+	encOpts []encoding.Option
+	limits encoding.Limits
+	bodyOpts []encoding.Option
+	newHash func()(hash.Hash)
+	closeOnChecksum bool
+	compressor Compressor
+	compressMin int
+	compStats *CompressionStats
+	secure *secureState
+	auth Authenticator
+	identity string
+	info *PeerInfo
+	peer *PeerInfo
+	peerOnly bool
+	// handshakeErr is the error of the secure handshake or the authentication
+	handshakeErr error
 
 	status ConnState
 	statusmux sync.RWMutex
 	served chan struct{}
 	streamed chan struct{}
+	// switching is closed when the Conn starts to switch to a stream, it fails the pending asks
+	switching chan struct{}
+	switchOnce sync.Once
 	ctx context.Context
 	cancel context.CancelFunc
 
@@ -43,42 +67,71 @@ type Conn struct{
 	idmux sync.Mutex
 	idins uint32
 	waits map[uint32]chan PacketBase
+	streamIns uint32
+	streams map[uint32]*inStream
+	maxStreams int
+	// outStreams receives the rejection of the sending streams, it's guarded by idmux
+	outStreams map[uint32]chan error
 
 	pkts map[uint32]PacketNewer
+	handlers map[uint32]handlerFunc
+	workers int
+	queueSize int
+	orderKey func(p PacketBase)(key uint64, ok bool)
+	disp *dispatcher
 
 	OnPktNotFound func(id uint32, body encoding.Reader)
 	OnParseError func(pkt PacketBase, err error)
+	OnChecksumError func(err *ChecksumError)
+	// OnHandlerError receives the errors and the panics of the handlers with their details,
+	// which are not sent to the peer if they are not registered (see RegisterErrorCode).
+	// It's called by the workers at the same time if WithWorkers is set
+	OnHandlerError func(pkt PacketBase, err error)
 }
 
-func NewConn(r io.Reader, w io.Writer)(c *Conn){
-	return NewConnContext(context.Background(), r, w)
+func NewConn(r io.Reader, w io.Writer, opts ...ConnOption)(c *Conn){
+	return NewConnContext(context.Background(), r, w, opts...)
 }
 
-func NewConnContext(ctx context.Context, r io.Reader, w io.Writer)(c *Conn){
+func NewConnContext(ctx context.Context, r io.Reader, w io.Writer, opts ...ConnOption)(c *Conn){
 	ctx, cancel := context.WithCancel(ctx)
 	c = &Conn{
-		r: encoding.WrapReader(r),
-		w: encoding.WrapWriter(w),
 		status: ConnInited,
 		served: make(chan struct{}, 0),
 		streamed: make(chan struct{}, 0),
+		switching: make(chan struct{}, 0),
 		ctx: ctx,
 		cancel: cancel,
 		waits: make(map[uint32]chan PacketBase),
+		streams: make(map[uint32]*inStream),
+		maxStreams: DefaultMaxStreams,
+		outStreams: make(map[uint32]chan error),
 		pkts: make(map[uint32]PacketNewer),
+		handlers: make(map[uint32]handlerFunc),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.bodyOpts = append(c.encOpts[:len(c.encOpts):len(c.encOpts)], encoding.WithLimits(c.limits))
+	c.r = encoding.WrapReader(r, c.encOpts...)
+	c.w = encoding.WrapWriter(w, c.encOpts...)
+	if c.workers > 0 {
+		c.disp = newDispatcher(c, c.workers, c.queueSize, c.orderKey)
+	}else if c.orderKey != nil {
+		panic("WithOrderKey requires WithWorkers")
 	}
 	c.initPkts()
 	return
 }
 
-func Pipe()(a, b *Conn){
+func Pipe(opts ...ConnOption)(a, b *Conn){
 	ar, bw := io.Pipe()
 	br, aw := io.Pipe()
-	a, b = NewConn(ar, aw), NewConn(br, bw)
+	a, b = NewConn(ar, aw, opts...), NewConn(br, bw, opts...)
 	return
 }
 
-func OsPipe()(c *Conn, br, bw *os.File, err error){
+func OsPipe(opts ...ConnOption)(c *Conn, br, bw *os.File, err error){
 	ar, bw, err := os.Pipe()
 	if err != nil {
 		return
@@ -87,7 +140,7 @@ func OsPipe()(c *Conn, br, bw *os.File, err error){
 	if err != nil {
 		return
 	}
-	c = NewConn(ar, aw)
+	c = NewConn(ar, aw, opts...)
 	return
 }
 
@@ -113,8 +166,11 @@ func (c *Conn)initPkts(){
 	c.AddPacket(func()(PacketBase){ return new(Ping) })
 	c.AddPacket(func()(PacketBase){ return new(Pong) })
 	c.AddPacket(func()(PacketBase){ return OkPkt })
+	c.AddPacket(func()(PacketBase){ return new(errorPkt) })
 	c.AddPacket(func()(PacketBase){ return stmPing })
 	c.AddPacket(func()(PacketBase){ return stmPong })
+	c.AddPacket(func()(PacketBase){ return new(streamChunk) })
+	c.AddPacket(func()(PacketBase){ return new(streamEnd) })
 }
 
 func (c *Conn)AddPacket(newer PacketNewer){
@@ -132,6 +188,7 @@ func (c *Conn)AddPacket(newer PacketNewer){
 func (c *Conn)PopPacket(pid uint32)(ok bool){
 	if _, ok = c.pkts[pid]; ok {
 		delete(c.pkts, pid)
+		delete(c.handlers, pid)
 	}
 	return
 }
@@ -159,11 +216,11 @@ func (c *Conn)Ping()(ping time.Duration, err error){
 func (c *Conn)PingWith(ctx context.Context)(ping time.Duration, err error){
 	begin := time.Now()
 	pay := (uint64)(begin.Unix() * 1000 + begin.UnixNano() / 1000000 % 1000)
-	var res PacketBase
-	if res, err = c.AskWith(ctx, &Ping{pay}); err != nil {
+	var res *Pong
+	if res, err = AskT[*Pong](ctx, c, &Ping{pay}); err != nil {
 		return
 	}
-	if pay != res.(*Pong).Payload {
+	if pay != res.Payload {
 		err = errors.New("ping-pong payload not same")
 		return
 	}
@@ -195,16 +252,32 @@ func (c *Conn)AskWith(ctx context.Context, p PacketBase)(res PacketBase, err err
 		id++
 	}
 	c.waits[id] = ch
-	defer delete(c.waits, id)
 	c.idmux.Unlock()
+	defer func(){
+		c.idmux.Lock()
+		delete(c.waits, id)
+		c.idmux.Unlock()
+	}()
 
+	select {
+	case <-c.switching:
+		// the response would be sent after the peer switched to the stream
+		return nil, ErrStreamed
+	default:
+	}
 	if err = c.send(p, id, SendAsk); err != nil {
 		return
 	}
 
 	select {
 	case res = <- ch:
-		return
+	case <-c.switching:
+		// Serve does not receive any response after the switch, but the received one is still returned
+		select {
+		case res = <- ch:
+		default:
+			return nil, ErrStreamed
+		}
 	case <-ctx.Done():
 		err = ctx.Err()
 		return
@@ -212,14 +285,50 @@ func (c *Conn)AskWith(ctx context.Context, p PacketBase)(res PacketBase, err err
 		err = c.ctx.Err()
 		return
 	}
+	if ep, ok := res.(*errorPkt); ok {
+		return nil, &RemoteError{Code: ep.Code, Message: ep.Message, Details: ep.Details}
+	}
+	err = checkResponse(p, res)
+	return
 }
 
+// startSwitch fails the pending asks, and waits for the dispatched handlers before the Conn switches to a stream
+func (c *Conn)startSwitch()(err error){
+	c.switchOnce.Do(func(){ close(c.switching) })
+	if c.disp != nil && !c.disp.wait(streamDrainTimeout) {
+		return ErrStreamDrain
+	}
+	return nil
+}
+
+// send writes the frame of the packet, the frame layout is defined by package github.com/kmcsr/go-pio/vectors
 func (c *Conn)send(p PacketBase, id uint32, ask byte)(err error){
 	if ask == NoAsk {
 		id = 0
 	}
+	if c.hasHandshake() {
+		select {
+		case <-c.served:
+		case <-c.ctx.Done():
+		}
+		select {
+		case <-c.served:
+			if c.handshakeErr != nil {
+				return c.handshakeErr
+			}
+		default:
+			return c.ctx.Err()
+		}
+	}
+	// the hello exchange has completed after served is closed
+	if c.peerOnly && ask != RecvAsk {
+		if peer := c.PeerInfo(); peer != nil && !peer.HasPacket(p.PktId()) {
+			return &UnsupportedPacketError{p.PktId()}
+		}
+	}
+
 	buf := bytes.NewBuffer(nil)
-	wr := encoding.WrapWriter(buf)
+	wr := encoding.WrapWriter(buf, c.encOpts...)
 	wr.WriteUint32(id)
 	wr.WriteByte(ask)
 	wr.WriteUint32(p.PktId())
@@ -227,15 +336,47 @@ func (c *Conn)send(p PacketBase, id uint32, ask byte)(err error){
 		return
 	}
 
+	body := buf.Bytes()
+	if c.compressor != nil {
+		if body, err = c.compressBody(body); err != nil {
+			return
+		}
+	}
+	if c.newHash != nil {
+		h := c.newHash()
+		h.Write(body)
+		body = h.Sum(body)
+	}
+
 	c.wmux.Lock()
 	defer c.wmux.Unlock()
 
-	if err = c.w.WriteBytes(buf.Bytes()); err != nil {
+	if c.secure != nil {
+		body = c.secure.seal(body)
+	}
+	if err = c.w.WriteBytes(body); err != nil {
 		return
 	}
 	return
 }
 
+func (c *Conn)readFrame()(buf []byte, err error){
+	return c.readFrameMax(c.limits.MaxFrameSize)
+}
+
+// readFrameMax reads a frame which is not larger than max, a zero max means no limit.
+// The buffer grows while the frame arrives, so the length prefix alone cannot allocate the memory
+func (c *Conn)readFrameMax(max uint32)(buf []byte, err error){
+	var l uint32
+	if l, err = c.r.ReadLength(); err != nil {
+		return
+	}
+	if max > 0 && l > max {
+		return nil, &encoding.LimitError{Limit: "MaxFrameSize", Max: (int64)(max), Size: (int64)(l)}
+	}
+	return encoding.ReadN(c.r, (int64)(l))
+}
+
 func (c *Conn)parser(buf []byte)(err error){
 	var (
 		id uint32
@@ -244,7 +385,7 @@ func (c *Conn)parser(buf []byte)(err error){
 		p PacketBase
 	)
 
-	rd := encoding.WrapReader(bytes.NewReader(buf))
+	rd := encoding.NewSliceReader(buf, c.bodyOpts...)
 	if id, err = rd.ReadUint32(); err != nil {
 		return
 	}
@@ -254,11 +395,22 @@ func (c *Conn)parser(buf []byte)(err error){
 	if pid, err = rd.ReadUint32(); err != nil {
 		return
 	}
+	if ask & Compressed != 0 {
+		ask &^= Compressed
+		var payload []byte
+		if payload, err = c.decompressPayload(buf[frameHeaderSize:]); err != nil {
+			return
+		}
+		rd = encoding.NewSliceReader(payload, c.bodyOpts...)
+	}
 	p = c.NewPacket(pid)
 	if p == nil {
 		if c.OnPktNotFound != nil {
 			c.OnPktNotFound(pid, rd)
 		}
+		if ask == SendAsk {
+			return c.replyError(id, fmt.Errorf("%w 0x%02x", ErrUnknownPacket, pid))
+		}
 		return
 	}
 	err = p.ParseFrom(rd)
@@ -266,21 +418,26 @@ func (c *Conn)parser(buf []byte)(err error){
 		if c.OnParseError != nil {
 			c.OnParseError(p, err)
 		}
+		if ask == SendAsk {
+			if er := c.replyError(id, fmt.Errorf("%w 0x%02x: %v", ErrParsePacket, pid, err)); er != nil {
+				return er
+			}
+		}
 		return
 	}
 	switch ask {
 	case SendAsk:
-		pa := p.(PacketAsk)
-		var rv PacketBase
-		if rv, err = pa.Ask(); err != nil {
+		c.statusmux.RLock()
+		st := c.status
+		c.statusmux.RUnlock()
+		if st == ConnPreStream {
+			// the peer reads the stream ping before the response, and fails the ask by itself
 			return
 		}
-		if rv == nil {
-			rv = OkPkt
-		}
-		if err = c.send(rv, id, RecvAsk); err != nil {
-			return
+		if c.disp != nil {
+			return c.disp.dispatch(p, func(){ c.handleAsk(id, pid, p) })
 		}
+		return c.handleAsk(id, pid, p)
 	case RecvAsk:
 		c.idmux.Lock()
 		ch, ok := c.waits[id]
@@ -291,23 +448,117 @@ func (c *Conn)parser(buf []byte)(err error){
 		if ok {
 			ch <- p
 		}
+	case StreamHead:
+		if ep, ok := p.(*errorPkt); ok {
+			c.onStreamRejected(id, ep)
+			return
+		}
+		return c.openStream(id, p)
 	case NoAsk:
 		if p == stmPing {
+			// the responses of the dispatched asks must be sent before the stream pong
+			if err = c.startSwitch(); err != nil {
+				return
+			}
 			if err = c.send(stmPong, 0, NoAsk); err != nil {
 				return
 			}
 			return streamingErr
 		}
 		if p == stmPong {
-			return streamingErr
-		}
-		if pa, ok := p.(Packet); ok {
-			if err = pa.Trigger(); err != nil {
+			if err = c.startSwitch(); err != nil {
 				return
 			}
+			return streamingErr
 		}
+		switch sp := p.(type) {
+		case *streamChunk:
+			c.onStreamChunk(sp)
+			return
+		case *streamEnd:
+			c.onStreamEnd(sp)
+			return
+		}
+		if c.disp != nil {
+			return c.disp.dispatch(p, func(){ c.trigger(pid, p) })
+		}
+		return c.trigger(pid, p)
 	default:
-		panic("Unexpected ask mask")
+		err = fmt.Errorf("%w 0x%02x: unexpected ask 0x%02x", ErrParsePacket, pid, ask)
+		if c.OnParseError != nil {
+			c.OnParseError(p, err)
+		}
+		return
+	}
+	return
+}
+
+// trigger calls the handler of the packet which is sent without ask.
+// A panic of the handler is returned as ErrHandlerPanic
+func (c *Conn)trigger(pid uint32, p PacketBase)(err error){
+	defer func(){
+		if err != nil && c.OnHandlerError != nil {
+			c.OnHandlerError(p, err)
+		}
+	}()
+	defer func(){
+		if v := recover(); v != nil {
+			err = fmt.Errorf("%w: %v", ErrHandlerPanic, v)
+		}
+	}()
+	if h, ok := c.handlers[pid]; ok {
+		_, err := h(c.handlerContext(0), p)
+		return err
+	}
+	if pa, ok := p.(PacketContext); ok {
+		return pa.TriggerContext(c.handlerContext(0), c)
+	}
+	if pa, ok := p.(Packet); ok {
+		return pa.Trigger()
+	}
+	return nil
+}
+
+// handleAsk calls the handler of the ask packet, and replies the response or the error
+func (c *Conn)handleAsk(id uint32, pid uint32, p PacketBase)(err error){
+	var rv PacketBase
+	if rv, err = c.callAsk(id, pid, p); err != nil {
+		if c.OnHandlerError != nil {
+			c.OnHandlerError(p, err)
+		}
+		if er := c.replyError(id, err); er != nil {
+			return er
+		}
+		return
+	}
+	return c.send(rv, id, RecvAsk)
+}
+
+// callAsk calls the handler of the ask packet, and returns the checked response.
+// A panic of the handler is returned as ErrHandlerPanic
+func (c *Conn)callAsk(id uint32, pid uint32, p PacketBase)(rv PacketBase, err error){
+	defer func(){
+		if v := recover(); v != nil {
+			rv, err = nil, fmt.Errorf("%w: %v", ErrHandlerPanic, v)
+		}
+	}()
+	if h, ok := c.handlers[pid]; ok {
+		rv, err = h(c.handlerContext(id), p)
+	}else if pa, ok := p.(PacketAskContext); ok {
+		rv, err = pa.AskContext(c.handlerContext(id), c)
+	}else if pa, ok := p.(PacketAsk); ok {
+		rv, err = pa.Ask()
+	}else{
+		return nil, fmt.Errorf("pio: packet 0x%02x cannot be asked", pid)
+	}
+	if err != nil {
+		return
+	}
+	if rv == nil {
+		rv = OkPkt
+	}
+	if err = checkResponse(p, rv); err != nil {
+		return
 	}
 	return
 }
@@ -320,10 +571,20 @@ func (c *Conn)Serve()(err error){
 	}
 	c.status = ConnServing
 	c.statusmux.Unlock()
+	if err = c.handshake(); err != nil {
+		c.handshakeErr = err
+		close(c.served)
+		c.Close()
+		return
+	}
 	close(c.served)
+	if c.disp != nil {
+		c.disp.start(c.workers)
+	}
 
 	var buf []byte
 	defer c.cancel()
+	defer c.closeStreams()
 	for {
 		{
 			c.statusmux.RLock()
@@ -333,9 +594,27 @@ func (c *Conn)Serve()(err error){
 				break
 			}
 		}
-		if buf, err = c.r.ReadBytes(); err != nil {
+		if buf, err = c.readFrame(); err != nil {
 			return
 		}
+		if c.secure != nil {
+			if buf, err = c.secure.open(buf); err != nil {
+				return
+			}
+		}
+		if c.newHash != nil {
+			var ce *ChecksumError
+			if buf, ce = c.checkFrame(buf); ce != nil {
+				if c.OnChecksumError != nil {
+					c.OnChecksumError(ce)
+				}
+				if c.closeOnChecksum {
+					c.Close()
+					return ce
+				}
+				continue
+			}
+		}
 		if er := c.parser(buf); er != nil {
 			if er == streamingErr {
 				c.statusmux.Lock()
@@ -344,6 +623,14 @@ func (c *Conn)Serve()(err error){
 				close(c.streamed)
 				return
 			}
+			if er == ErrStreamDrain {
+				c.Close()
+				return er
+			}
+			var le *encoding.LimitError
+			if errors.As(er, &le) {
+				return er
+			}
 		}
 	}
 	return
@@ -356,10 +643,16 @@ type readWriteCloser struct{
 var _ io.ReadWriteCloser = readWriteCloser{}
 
 func (c readWriteCloser)Read(buf []byte)(n int, err error){
+	if c.c.secure != nil {
+		return c.secureRead(buf)
+	}
 	return c.c.r.Read(buf)
 }
 
 func (c readWriteCloser)Write(buf []byte)(n int, err error){
+	if c.c.secure != nil {
+		return c.secureWrite(buf)
+	}
 	return c.c.w.Write(buf)
 }
 
@@ -380,13 +673,20 @@ func (c *Conn)AsStream()(rw io.ReadWriteCloser, err error){
 			panic("pio.Conn is not serving")
 		}
 		c.status = ConnPreStream
+	}
+	c.statusmux.Unlock()
+
+	if streaming {
+		// send reads the peer info under statusmux, so the stream ping is sent after it's unlocked
 		if err = c.send(stmPing, 0, NoAsk); err != nil {
-			c.status = ConnServing
+			c.statusmux.Lock()
+			if c.status == ConnPreStream {
+				c.status = ConnServing
+			}
 			c.statusmux.Unlock()
 			return
 		}
 	}
-	c.statusmux.Unlock()
 
 	if streaming {
 		select {
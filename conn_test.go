@@ -2,9 +2,21 @@
 package pio_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
-	// "github.com/kmcsr/go-pio/encoding"
+	"github.com/kmcsr/go-pio/encoding"
 	. "github.com/kmcsr/go-pio"
 )
 
@@ -22,6 +34,51 @@ func TestConnPing(t *testing.T){
 	t.Logf("ping: %v", ping)
 }
 
+func TestConnBigEndian(t *testing.T){
+	c, d := Pipe(WithByteOrder(binary.BigEndian))
+	go d.Serve()
+	go c.Serve()
+	defer c.Close()
+	defer d.Close()
+
+	<-c.ServeDone()
+	if _, err := c.Ping(); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+}
+
+func TestConnLimits(t *testing.T){
+	c, d := Pipe(WithLimits(encoding.Limits{MaxFrameSize: 16}))
+	go c.Serve()
+	defer c.Close()
+	defer d.Close()
+
+	done := make(chan error, 1)
+	go func(){
+		done <- d.Serve()
+	}()
+	<-d.ServeDone()
+	go c.Send(&Ping{})
+	var le *encoding.LimitError
+	if err := <-done; !errors.As(err, &le) || le.Limit != "MaxFrameSize" {
+		t.Fatalf("Serve should return MaxFrameSize LimitError, got %v", err)
+	}
+}
+
+func TestConnHugeFrameLength(t *testing.T){
+	// a 4 GiB frame length without the body, there is no MaxFrameSize
+	c := NewConn(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3}), io.Discard)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if err := c.Serve(); err == nil {
+		t.Fatalf("Serve should fail on the short frame")
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 16 << 20 {
+		t.Fatalf("Serve allocated %d bytes for the frame length", n)
+	}
+}
+
 func TestConnAsStream(t *testing.T){
 	c, d := Pipe()
 	go d.Serve()
@@ -55,3 +112,1043 @@ func TestConnAsStream(t *testing.T){
 	}
 	t.Logf("Readed: '%v'", (string)(buf[:n]))
 }
+
+func TestConnChecksum(t *testing.T){
+	c, d := Pipe(WithCRC32C())
+	go d.Serve()
+	go c.Serve()
+	defer c.Close()
+	defer d.Close()
+
+	<-c.ServeDone()
+	if _, err := c.Ping(); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+}
+
+func TestConnChecksumMismatch(t *testing.T){
+	r, w := io.Pipe()
+	out, cw := io.Pipe()
+	go io.Copy(io.Discard, out)
+	c := NewConn(r, cw, WithCRC32C(), WithCloseOnChecksumError())
+	defer c.Close()
+	reported := make(chan *ChecksumError, 1)
+	c.OnChecksumError = func(err *ChecksumError){
+		reported <- err
+	}
+	done := make(chan error, 1)
+	go func(){
+		done <- c.Serve()
+	}()
+
+	body := []byte{0, 0, 0, 0, NoAsk, 0x04, 0, 0, 0}
+	sum := crc32.Checksum(body, crc32.MakeTable(crc32.Castagnoli))
+	frame := append(body, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(frame[len(body):], sum ^ 1)
+	wr := encoding.WrapWriter(w)
+	go wr.WriteBytes(frame)
+
+	var ce *ChecksumError
+	if err := <-done; !errors.As(err, &ce) {
+		t.Fatalf("Serve should return ChecksumError, got %v", err)
+	}
+	if err := <-reported; err != ce {
+		t.Fatalf("OnChecksumError got %v, expect %v", err, ce)
+	}
+	if err := c.Send(&Ping{}); err == nil {
+		t.Fatalf("Send should fail after the Conn is closed by the checksum error")
+	}
+	if _, err := c.Ask(&Ping{}); err == nil {
+		t.Fatalf("Ask should fail after the Conn is closed by the checksum error")
+	}
+}
+
+type echoPkt struct{
+	Data []float64
+}
+
+func (*echoPkt)PktId()(uint32){ return 0x7e }
+
+func (p *echoPkt)WriteTo(w encoding.Writer)(error){
+	return w.WriteFloat64s(p.Data)
+}
+
+func (p *echoPkt)ParseFrom(r encoding.Reader)(err error){
+	p.Data, err = r.ReadFloat64s()
+	return
+}
+
+func (p *echoPkt)Ask()(PacketBase, error){
+	return p, nil
+}
+
+func TestConnCompression(t *testing.T){
+	c, d := Pipe(WithCompression(nil, 64))
+	c.AddPacket(func()(PacketBase){ return new(echoPkt) })
+	d.AddPacket(func()(PacketBase){ return new(echoPkt) })
+	go d.Serve()
+	go c.Serve()
+	defer c.Close()
+	defer d.Close()
+
+	<-c.ServeDone()
+	if _, err := c.Ping(); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if s := c.CompressionStats(); s.SentFrames != 0 {
+		t.Fatalf("Ping should not be compressed, stats: %+v", s)
+	}
+	req := &echoPkt{Data: make([]float64, 1024)}
+	for i := range req.Data {
+		req.Data[i] = (float64)(i % 8)
+	}
+	res, err := c.Ask(req)
+	if err != nil {
+		t.Fatalf("Ask: %v", err)
+	}
+	if data := res.(*echoPkt).Data; len(data) != len(req.Data) || data[9] != 1 {
+		t.Fatalf("Unexpected response %v", data)
+	}
+	cs, ds := c.CompressionStats(), d.CompressionStats()
+	if cs.SentFrames != 1 || cs.RecvFrames != 1 || ds.SentFrames != 1 || ds.RecvFrames != 1 {
+		t.Fatalf("Unexpected stats %+v and %+v", cs, ds)
+	}
+	if cs.SentSaved() == 0 || cs.SentSaved() != ds.RecvSaved() {
+		t.Fatalf("Unexpected saved bytes %d and %d", cs.SentSaved(), ds.RecvSaved())
+	}
+}
+
+func TestConnCompressionDefaultLimit(t *testing.T){
+	c, d := Pipe(WithCompression(nil, 64))
+	c.AddPacket(func()(PacketBase){ return new(echoPkt) })
+	d.AddPacket(func()(PacketBase){ return new(echoPkt) })
+	served := make(chan error, 1)
+	go func(){ served <- d.Serve() }()
+	go c.Serve()
+	defer c.Close()
+	defer d.Close()
+
+	<-c.ServeDone()
+	// the zeros are compressed to a small frame, but they expand over DefaultMaxDecompressed
+	if err := c.Send(&echoPkt{Data: make([]float64, DefaultMaxDecompressed / 8 + 1)}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	var le *encoding.LimitError
+	if err := <-served; !errors.As(err, &le) {
+		t.Fatalf("Serve should return *encoding.LimitError, got %v", err)
+	}
+}
+
+func TestConnEncryption(t *testing.T){
+	c, d := Pipe(WithEncryption(nil))
+	go d.Serve()
+	go c.Serve()
+	defer c.Close()
+	defer d.Close()
+
+	<-c.ServeDone()
+	if _, err := c.Ping(); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	crw, err := c.AsStream()
+	if err != nil {
+		t.Fatalf("c.AsStream: %v", err)
+	}
+	<-d.StreamedDone()
+	drw, err := d.AsStream()
+	if err != nil {
+		t.Fatalf("d.AsStream: %v", err)
+	}
+	go crw.Write(([]byte)("hello secure pio"))
+	buf := make([]byte, 16)
+	if _, err := io.ReadFull(drw, buf); err != nil {
+		t.Fatalf("Read stream: %v", err)
+	}
+	if (string)(buf) != "hello secure pio" {
+		t.Fatalf("Unexpected stream data %q", buf)
+	}
+}
+
+func TestConnEncryptionKeys(t *testing.T){
+	newKey := func()(*ecdh.PrivateKey){
+		k, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("GenerateKey: %v", err)
+		}
+		return k
+	}
+	ka, kb, kx := newKey(), newKey(), newKey()
+	for _, tc := range []struct{
+		name string
+		a, b *SecureConfig
+		ok bool
+	}{
+		{"pinned", &SecureConfig{StaticKey: ka, PeerKey: kb.PublicKey()}, &SecureConfig{StaticKey: kb, PeerKey: ka.PublicKey()}, true},
+		{"wrong-peer", &SecureConfig{StaticKey: ka, PeerKey: kb.PublicKey()}, &SecureConfig{StaticKey: kx, PeerKey: ka.PublicKey()}, false},
+		{"psk", &SecureConfig{PreSharedKey: []byte("secret")}, &SecureConfig{PreSharedKey: []byte("secret")}, true},
+		{"wrong-psk", &SecureConfig{PreSharedKey: []byte("secret")}, &SecureConfig{PreSharedKey: []byte("Secret")}, false},
+		{"mode", &SecureConfig{PreSharedKey: []byte("secret")}, nil, false},
+	}{
+		t.Run(tc.name, func(t *testing.T){
+			ar, bw := io.Pipe()
+			br, aw := io.Pipe()
+			c := NewConn(ar, aw, WithEncryption(tc.a))
+			d := NewConn(br, bw, WithEncryption(tc.b))
+			defer c.Close()
+			defer d.Close()
+			go d.Serve()
+			done := make(chan error, 1)
+			go func(){
+				done <- c.Serve()
+			}()
+			<-c.ServeDone()
+			_, err := c.Ping()
+			if tc.ok {
+				if err != nil {
+					t.Fatalf("Ping: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Ping should fail")
+			}
+			if err := <-done; !errors.Is(err, ErrHandshake) {
+				t.Fatalf("Serve should return ErrHandshake, got %v", err)
+			}
+		})
+	}
+}
+
+func TestConnAuthHugeMessage(t *testing.T){
+	r, w := io.Pipe()
+	defer w.Close()
+	c := NewConn(r, io.Discard, WithAuthenticator(&HMACAuth{Identity: "server", Secret: []byte("secret")}))
+	done := make(chan error, 1)
+	go func(){
+		done <- c.Serve()
+	}()
+	// the length prefix of the first authentication message is larger than any message,
+	// it must be rejected before the body arrives
+	go w.Write([]byte{0x00, 0x00, 0x10, 0x00})
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("Serve should fail on the huge authentication message")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serve is waiting for the body of the huge authentication message")
+	}
+}
+
+func TestConnAuth(t *testing.T){
+	secrets := map[string][]byte{"alice": []byte("alice secret")}
+	lookup := func(id string)(secret []byte, ok bool){
+		secret, ok = secrets[id]
+		return
+	}
+	serverHMAC := &HMACAuth{Identity: "server", Lookup: lookup}
+	tokens := StaticTokens(map[string]string{"alice-token": "alice"})
+	for _, tc := range []struct{
+		name string
+		a, b Authenticator
+		opts []ConnOption
+		reason string
+	}{
+		{"hmac", &HMACAuth{Identity: "alice", Secret: []byte("alice secret")}, serverHMAC, nil, ""},
+		{"hmac-wrong-secret", &HMACAuth{Identity: "alice", Secret: []byte("wrong")}, serverHMAC, nil, "wrong secret"},
+		{"hmac-unknown", &HMACAuth{Identity: "bob", Secret: []byte("bob secret")}, serverHMAC, nil, "unknown identity"},
+		{"hmac-encrypted", &HMACAuth{Identity: "alice", Secret: []byte("alice secret")}, serverHMAC, []ConnOption{WithEncryption(nil)}, ""},
+		{"token", &TokenAuth{Token: "alice-token"}, &TokenAuth{Verify: tokens}, []ConnOption{WithEncryption(nil)}, ""},
+		{"token-invalid", &TokenAuth{Token: "bob-token"}, &TokenAuth{Verify: tokens}, []ConnOption{WithEncryption(nil)}, "invalid token"},
+	}{
+		t.Run(tc.name, func(t *testing.T){
+			ar, bw := io.Pipe()
+			br, aw := io.Pipe()
+			c := NewConn(ar, aw, append(tc.opts, WithAuthenticator(tc.a))...)
+			d := NewConn(br, bw, append(tc.opts, WithAuthenticator(tc.b))...)
+			defer c.Close()
+			defer d.Close()
+			cdone, ddone := make(chan error, 1), make(chan error, 1)
+			go func(){ cdone <- c.Serve() }()
+			go func(){ ddone <- d.Serve() }()
+			<-c.ServeDone()
+			<-d.ServeDone()
+			if tc.reason == "" {
+				if _, err := c.Ping(); err != nil {
+					t.Fatalf("Ping: %v", err)
+				}
+				if id := d.Identity(); id != "alice" {
+					t.Fatalf("Identity is %q, expect alice", id)
+				}
+				return
+			}
+			var ae *AuthError
+			if err := <-ddone; !errors.As(err, &ae) || ae.Remote || ae.Reason != tc.reason {
+				t.Fatalf("Serve of the verifier should return AuthError %q, got %v", tc.reason, err)
+			}
+			if err := <-cdone; !errors.As(err, &ae) || ae.Reason != tc.reason {
+				t.Fatalf("Serve of the rejected side should return AuthError %q, got %v", tc.reason, err)
+			}
+			if err := c.Send(&Ping{}); !errors.As(err, &ae) {
+				t.Fatalf("Send should return the AuthError, got %v", err)
+			}
+		})
+	}
+}
+
+func TestConnHello(t *testing.T){
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+	c := NewConn(ar, aw, WithHello("demo", "1.0", "stream", "zip"), WithPeerPacketsOnly())
+	d := NewConn(br, bw, WithHello("demo", "2.0", "stream"))
+	c.AddPacket(func()(PacketBase){ return new(echoPkt) })
+	defer c.Close()
+	defer d.Close()
+	go c.Serve()
+	go d.Serve()
+	<-c.ServeDone()
+	<-d.ServeDone()
+
+	info := c.PeerInfo()
+	if info == nil || info.Protocol != ProtocolVersion || info.App != "demo" || info.AppVersion != "2.0" {
+		t.Fatalf("Unexpected peer info %+v", info)
+	}
+	if !info.HasFeature("stream") || info.HasFeature("zip") {
+		t.Fatalf("Unexpected peer features %v", info.Features)
+	}
+	if !d.PeerInfo().HasFeature("zip") || !d.PeerInfo().HasPacket(0x7e) {
+		t.Fatalf("Unexpected peer info %+v", d.PeerInfo())
+	}
+	if c.PeerSupports(0x7e) || !c.PeerSupports(0x01) {
+		t.Fatalf("PeerSupports reports wrong result")
+	}
+	if _, err := c.Ping(); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	var ue *UnsupportedPacketError
+	if err := c.Send(&echoPkt{}); !errors.As(err, &ue) || ue.PktId != 0x7e {
+		t.Fatalf("Send should return UnsupportedPacketError, got %v", err)
+	}
+}
+
+func TestConnPeerPacketsBeforeHello(t *testing.T){
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+	c := NewConn(ar, aw, WithHello("demo", "1.0"), WithPeerPacketsOnly())
+	d := NewConn(br, bw, WithHello("demo", "2.0"))
+	c.AddPacket(func()(PacketBase){ return new(echoPkt) })
+	defer c.Close()
+	defer d.Close()
+	errc := make(chan error, 1)
+	go func(){
+		errc <- c.Send(&echoPkt{})
+	}()
+	go c.Serve()
+	go d.Serve()
+	var ue *UnsupportedPacketError
+	select {
+	case err := <-errc:
+		if !errors.As(err, &ue) || ue.PktId != 0x7e {
+			t.Fatalf("Send should return UnsupportedPacketError, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Send is not returned")
+	}
+}
+
+type filePkt struct{
+	Name string
+	recv chan []byte
+	err chan error
+}
+
+func (*filePkt)PktId()(uint32){ return 0x7d }
+
+func (p *filePkt)WriteTo(w encoding.Writer)(error){
+	return w.WriteString(p.Name)
+}
+
+func (p *filePkt)ParseFrom(r encoding.Reader)(err error){
+	p.Name, err = r.ReadString()
+	return
+}
+
+func (p *filePkt)OnStream(r io.Reader){
+	data, err := io.ReadAll(r)
+	p.recv <- data
+	p.err <- err
+}
+
+func TestConnSendStream(t *testing.T){
+	c, d := Pipe()
+	recv, errs := make(chan []byte, 1), make(chan error, 1)
+	c.AddPacket(func()(PacketBase){ return new(filePkt) })
+	d.AddPacket(func()(PacketBase){ return &filePkt{recv: recv, err: errs} })
+	go d.Serve()
+	go c.Serve()
+	defer c.Close()
+	defer d.Close()
+	<-c.ServeDone()
+
+	data := make([]byte, 1 << 20)
+	rand.Read(data)
+	sent := make(chan error, 1)
+	go func(){
+		sent <- c.SendStream(&filePkt{Name: "a.bin"}, bytes.NewReader(data), (int64)(len(data)))
+	}()
+	// other packets are not blocked by the stream
+	for i := 0; i < 4; i++ {
+		if _, err := c.Ping(); err != nil {
+			t.Fatalf("Ping: %v", err)
+		}
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("SendStream: %v", err)
+	}
+	if got := <-recv; !bytes.Equal(got, data) {
+		t.Fatalf("Received %d bytes, which are not same as the sent data", len(got))
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Read stream: %v", err)
+	}
+
+	if err := c.SendStream(&filePkt{Name: "short"}, bytes.NewReader(data[:100]), 200); err != io.ErrUnexpectedEOF {
+		t.Fatalf("SendStream a short reader should return io.ErrUnexpectedEOF, got %v", err)
+	}
+	if got := <-recv; !bytes.Equal(got, data[:100]) {
+		t.Fatalf("Received %d bytes, expect 100", len(got))
+	}
+	var se *StreamError
+	if err := <-errs; !errors.As(err, &se) {
+		t.Fatalf("Read aborted stream should return StreamError, got %v", err)
+	}
+}
+
+func TestConnMaxStreams(t *testing.T){
+	c, d := Pipe(WithMaxStreams(1))
+	recv, errs := make(chan []byte, 2), make(chan error, 2)
+	c.AddPacket(func()(PacketBase){ return new(filePkt) })
+	d.AddPacket(func()(PacketBase){ return &filePkt{recv: recv, err: errs} })
+	go d.Serve()
+	go c.Serve()
+	defer c.Close()
+	defer d.Close()
+	<-c.ServeDone()
+
+	// the first stream is kept open until the reader is closed
+	pr, pw := io.Pipe()
+	sent := make(chan error, 1)
+	go func(){
+		sent <- c.SendStream(&filePkt{Name: "open"}, pr, -1)
+	}()
+	if _, err := pw.Write([]byte("data")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	// the second stream is rejected, and the rest of its chunks are not sent
+	if err := c.SendStream(&filePkt{Name: "extra"}, zeroReader{}, -1); !errors.Is(err, ErrTooManyStreams) {
+		t.Fatalf("SendStream should return ErrTooManyStreams, got %v", err)
+	}
+	pw.Close()
+	if err := <-sent; err != nil {
+		t.Fatalf("SendStream: %v", err)
+	}
+	if got := <-recv; string(got) != "data" {
+		t.Fatalf("Received %q, expect \"data\"", got)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Read stream: %v", err)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader)Read(buf []byte)(int, error){
+	for i := range buf {
+		buf[i] = 0
+	}
+	return len(buf), nil
+}
+
+func TestConnUnknownAsk(t *testing.T){
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+	c := NewConn(ar, aw)
+	defer c.Close()
+	parseErr := make(chan error, 1)
+	c.OnParseError = func(p PacketBase, err error){
+		parseErr <- err
+	}
+	done := make(chan error, 1)
+	go func(){
+		done <- c.Serve()
+	}()
+	go io.Copy(io.Discard, br)
+
+	body := new(bytes.Buffer)
+	bd := encoding.WrapWriter(body)
+	bd.WriteUint32(0)
+	bd.WriteByte(0x05)
+	bd.WriteUint32((*Ping)(nil).PktId())
+	bd.WriteUint64(0)
+	if err := encoding.WrapWriter(bw).WriteBytes(body.Bytes()); err != nil {
+		t.Fatalf("Write frame: %v", err)
+	}
+	select {
+	case err := <-parseErr:
+		if !errors.Is(err, ErrParsePacket) {
+			t.Fatalf("OnParseError should receive ErrParsePacket, got %v", err)
+		}
+	case err := <-done:
+		t.Fatalf("Serve returned %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The frame is not parsed")
+	}
+}
+
+type ctxPkt struct{
+	Val uint32
+	got chan *Conn
+	done chan error
+}
+
+func (*ctxPkt)PktId()(uint32){ return 0x7c }
+
+func (p *ctxPkt)WriteTo(w encoding.Writer)(error){
+	return w.WriteUint32(p.Val)
+}
+
+func (p *ctxPkt)ParseFrom(r encoding.Reader)(err error){
+	p.Val, err = r.ReadUint32()
+	return
+}
+
+func (p *ctxPkt)TriggerContext(ctx context.Context, c *Conn)(error){
+	if id, ok := RequestIdFromContext(ctx); !ok || id != 0 || ConnFromContext(ctx) != c {
+		return errors.New("bad handler context")
+	}
+	p.got <- c
+	if p.Val != 1 {
+		return nil
+	}
+	// reply to the sender, and wait the Conn closed
+	if err := c.Send(&ctxPkt{Val: p.Val + 1}); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	p.done <- ctx.Err()
+	return nil
+}
+
+func (p *ctxPkt)AskContext(ctx context.Context, c *Conn)(PacketBase, error){
+	id, ok := RequestIdFromContext(ctx)
+	if !ok || id == 0 {
+		return nil, errors.New("missing request id")
+	}
+	return &ctxPkt{Val: p.Val + id}, nil
+}
+
+func TestConnHandlerContext(t *testing.T){
+	c, d := Pipe()
+	got, replies, done := make(chan *Conn, 1), make(chan *Conn, 1), make(chan error, 1)
+	c.AddPacket(func()(PacketBase){ return &ctxPkt{got: replies, done: make(chan error, 1)} })
+	d.AddPacket(func()(PacketBase){ return &ctxPkt{got: got, done: done} })
+	go d.Serve()
+	go c.Serve()
+	defer c.Close()
+	<-c.ServeDone()
+
+	res, err := c.Ask(&ctxPkt{Val: 10})
+	if err != nil {
+		t.Fatalf("Ask: %v", err)
+	}
+	if v := res.(*ctxPkt).Val; v <= 10 {
+		t.Fatalf("Unexpected response %d", v)
+	}
+	if err := c.Send(&ctxPkt{Val: 1}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if conn := <-got; conn != d {
+		t.Fatalf("TriggerContext received a wrong Conn")
+	}
+	if conn := <-replies; conn != c {
+		t.Fatalf("The reply is received by a wrong Conn")
+	}
+	d.Close()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("Handler context should be canceled after the Conn closed, got %v", err)
+	}
+}
+
+// dataPkt has no behavior, the handlers are registered by Handle and HandleAsk
+type dataPkt struct{
+	Name string
+}
+
+func (*dataPkt)PktId()(uint32){ return 0x7b }
+
+func (p *dataPkt)WriteTo(w encoding.Writer)(error){
+	return w.WriteString(p.Name)
+}
+
+func (p *dataPkt)ParseFrom(r encoding.Reader)(err error){
+	p.Name, err = r.ReadString()
+	return
+}
+
+func TestConnHandle(t *testing.T){
+	c, d := Pipe()
+	recv := make(chan string, 4)
+	Handle(c, func(ctx context.Context, p *dataPkt)(error){
+		if ConnFromContext(ctx) != c {
+			return errors.New("bad handler context")
+		}
+		recv <- p.Name
+		return nil
+	})
+	HandleAsk(d, func(ctx context.Context, p *dataPkt)(*dataPkt, error){
+		if p.Name == "" {
+			return nil, nil
+		}
+		// reply by a separate packet too
+		if err := ConnFromContext(ctx).Send(&dataPkt{Name: "sent " + p.Name}); err != nil {
+			return nil, err
+		}
+		return &dataPkt{Name: "re " + p.Name}, nil
+	})
+	go d.Serve()
+	go c.Serve()
+	defer c.Close()
+	defer d.Close()
+	<-c.ServeDone()
+
+	res, err := c.Ask(&dataPkt{Name: "pio"})
+	if err != nil {
+		t.Fatalf("Ask: %v", err)
+	}
+	if p, ok := res.(*dataPkt); !ok || p.Name != "re pio" {
+		t.Fatalf("Unexpected response %#v", res)
+	}
+	if name := <-recv; name != "sent pio" {
+		t.Fatalf("Handle received %q", name)
+	}
+	if res, err = c.Ask(&dataPkt{}); err != nil || res != OkPkt {
+		t.Fatalf("Ask with a nil response should receive Ok, got %#v, %v", res, err)
+	}
+	if err := d.Send(&dataPkt{Name: "push"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if name := <-recv; name != "push" {
+		t.Fatalf("Handle received %q", name)
+	}
+}
+
+// pongAsk declares Pong as its response, but the handler on the peer replies Ok
+type pongAsk struct{
+	EmptyPkt
+}
+
+func (pongAsk)ResponsePktId()(uint32){ return (*Pong)(nil).PktId() }
+
+func TestConnAskT(t *testing.T){
+	c, d := Pipe()
+	c.AddPacket(func()(PacketBase){ return new(echoPkt) })
+	d.AddPacket(func()(PacketBase){ return new(echoPkt) })
+	c.AddPacket(func()(PacketBase){ return pongAsk{EmptyPkt{0x7a}} })
+	d.AddPacket(func()(PacketBase){ return NewPktAsk(0x7a, func()(PacketBase, error){ return nil, nil }) })
+	go d.Serve()
+	go c.Serve()
+	defer c.Close()
+	defer d.Close()
+	<-c.ServeDone()
+
+	ctx := context.Background()
+	pong, err := AskT[*Pong](ctx, c, &Ping{Payload: 7})
+	if err != nil || pong.Payload != 7 {
+		t.Fatalf("AskT returned %v, %v", pong, err)
+	}
+	var re *ResponseTypeError
+	if _, err := AskT[*Pong](ctx, c, &echoPkt{}); !errors.As(err, &re) || re.Request != 0x7e || re.Expect != "*pio.Pong" {
+		t.Fatalf("AskT should return ResponseTypeError, got %v", err)
+	}
+	t.Logf("error: %v", re)
+	if _, err := c.Ask(pongAsk{EmptyPkt{0x7a}}); !errors.As(err, &re) || re.Response != OkPkt {
+		t.Fatalf("Ask should check the declared response, got %v", err)
+	}
+}
+
+var (
+	errNotFound = errors.New("not found")
+	errConflict = errors.New("conflict")
+)
+
+func init(){
+	RegisterErrorCode(0x1001, errNotFound)
+	RegisterErrorCode(0x1003, errConflict)
+}
+
+func TestConnRemoteError(t *testing.T){
+	c, d := Pipe()
+	c.AddPacket(func()(PacketBase){ return new(dataPkt) })
+	d.AddPacket(func()(PacketBase){ return new(filePkt) })
+	HandleAsk(d, func(ctx context.Context, p *dataPkt)(*dataPkt, error){
+		switch p.Name {
+		case "missing":
+			return nil, fmt.Errorf("user %s: %w", p.Name, errNotFound)
+		case "both":
+			return nil, errors.Join(errConflict, errNotFound)
+		case "panic":
+			panic("boom")
+		case "secret":
+			return nil, errors.New("dial 10.0.0.1: refused")
+		case "custom":
+			return nil, NewRemoteError(0x2002, "custom error", []byte{1, 2})
+		}
+		return p, nil
+	})
+	handlerErrs := make(chan error, 16)
+	d.OnHandlerError = func(pkt PacketBase, err error){
+		handlerErrs <- err
+	}
+	go d.Serve()
+	go c.Serve()
+	defer c.Close()
+	defer d.Close()
+	<-c.ServeDone()
+
+	var re *RemoteError
+	_, err := c.Ask(&dataPkt{Name: "missing"})
+	if !errors.Is(err, errNotFound) || !errors.As(err, &re) || re.Code != 0x1001 || re.Message != "user missing: not found" {
+		t.Fatalf("Ask should return the registered error, got %v", err)
+	}
+	// the code which is registered first is used
+	for i := 0; i < 8; i++ {
+		if _, err = c.Ask(&dataPkt{Name: "both"}); !errors.As(err, &re) || re.Code != 0x1001 {
+			t.Fatalf("Ask should return the code 0x1001, got %v", err)
+		}
+	}
+	if _, err = c.Ask(&dataPkt{Name: "panic"}); !errors.Is(err, ErrHandlerPanic) || strings.Contains(err.Error(), "boom") {
+		t.Fatalf("Ask should return ErrHandlerPanic without the panic value, got %v", err)
+	}
+	if _, err = c.Ask(&dataPkt{Name: "secret"}); !errors.As(err, &re) || re.Code != ErrCodeInternal || strings.Contains(re.Message, "10.0.0.1") {
+		t.Fatalf("Ask should return the internal error without the message, got %v", err)
+	}
+	// the handler errors are reported on this side with the details
+	var details []string
+	for len(handlerErrs) > 0 {
+		details = append(details, (<-handlerErrs).Error())
+	}
+	if got := strings.Join(details, "\n"); !strings.Contains(got, "boom") || !strings.Contains(got, "10.0.0.1") {
+		t.Fatalf("OnHandlerError should receive the details, got %q", got)
+	}
+	if _, err = c.Ask(&dataPkt{Name: "custom"}); !errors.As(err, &re) || re.Code != 0x2002 || !bytes.Equal(re.Details, []byte{1, 2}) {
+		t.Fatalf("Ask should return the custom RemoteError, got %v", err)
+	}
+	if _, err = c.Ask(NewPkt(0x79)); !errors.Is(err, ErrUnknownPacket) {
+		t.Fatalf("Ask an unknown packet should return ErrUnknownPacket, got %v", err)
+	}
+	// filePkt has a string, but the empty packet has no payload
+	if _, err = c.Ask(NewPkt(0x7d)); !errors.Is(err, ErrParsePacket) {
+		t.Fatalf("Ask a bad packet should return ErrParsePacket, got %v", err)
+	}
+	if res, err := c.Ask(&dataPkt{Name: "ok"}); err != nil || res.(*dataPkt).Name != "ok" {
+		t.Fatalf("Ask after the errors returned %v, %v", res, err)
+	}
+}
+
+func TestConnWorkers(t *testing.T){
+	c, d := Pipe(WithWorkers(4, 16))
+	started, release := make(chan struct{}), make(chan struct{})
+	c.AddPacket(func()(PacketBase){ return new(dataPkt) })
+	HandleAsk(d, func(ctx context.Context, p *dataPkt)(*dataPkt, error){
+		switch p.Name {
+		case "slow":
+			close(started)
+			<-release
+		case "nested":
+			// the pong is received by the serving goroutine while this handler waits
+			if _, err := ConnFromContext(ctx).Ping(); err != nil {
+				return nil, err
+			}
+		}
+		return p, nil
+	})
+	go d.Serve()
+	go c.Serve()
+	defer c.Close()
+	defer d.Close()
+	<-c.ServeDone()
+
+	slow := make(chan error, 1)
+	go func(){
+		_, err := c.Ask(&dataPkt{Name: "slow"})
+		slow <- err
+	}()
+	<-started
+	if _, err := c.Ask(&dataPkt{Name: "nested"}); err != nil {
+		t.Fatalf("Ask nested: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := c.Ping(); err != nil {
+			t.Fatalf("Ping while a handler is blocked: %v", err)
+		}
+	}
+	if s := d.DispatchStats(); s.Running < 1 {
+		t.Fatalf("Unexpected dispatch stats %+v", s)
+	}
+	close(release)
+	if err := <-slow; err != nil {
+		t.Fatalf("Ask slow: %v", err)
+	}
+}
+
+func TestConnWorkersOrder(t *testing.T){
+	c, d := Pipe(WithWorkers(4, 8), WithOrderByPacket())
+	recv := make(chan string, 200)
+	Handle(d, func(ctx context.Context, p *dataPkt)(error){
+		recv <- p.Name
+		return nil
+	})
+	go d.Serve()
+	go c.Serve()
+	defer c.Close()
+	defer d.Close()
+	<-c.ServeDone()
+
+	const n = 200
+	for i := 0; i < n; i++ {
+		if err := c.Send(&dataPkt{Name: fmt.Sprint(i)}); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if name := <-recv; name != fmt.Sprint(i) {
+			t.Fatalf("Packet %d is handled at %d", i, len(recv))
+		}
+	}
+	if s := d.DispatchStats(); s.MaxQueued < 1 {
+		t.Fatalf("Unexpected dispatch stats %+v", s)
+	}
+}
+
+func TestConnWorkersAsStream(t *testing.T){
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+	c, d := NewConn(ar, aw), NewConn(br, bw, WithWorkers(2, 4))
+	started, release := make(chan struct{}), make(chan struct{})
+	pinged := make(chan error, 1)
+	Handle(d, func(ctx context.Context, p *dataPkt)(error){
+		switch p.Name {
+		case "panic":
+			panic("trigger handler panic")
+		case "ping":
+			close(started)
+			<-release
+			// the ask must fail instead of blocking the stream switch
+			_, err := ConnFromContext(ctx).Ping()
+			pinged <- err
+		}
+		return nil
+	})
+	go d.Serve()
+	go c.Serve()
+	defer c.Close()
+	defer d.Close()
+	<-c.ServeDone()
+
+	if err := c.Send(&dataPkt{Name: "panic"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if err := c.Send(&dataPkt{Name: "ping"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	<-started
+	streamed := make(chan io.ReadWriteCloser, 1)
+	go func(){
+		crw, err := c.AsStream()
+		if err != nil {
+			t.Errorf("c.AsStream: %v", err)
+		}
+		streamed <- crw
+	}()
+	// let d receive the stream ping while the handler is running
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	var crw io.ReadWriteCloser
+	select {
+	case crw = <-streamed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The stream switch is blocked by the handler")
+	}
+	if err := <-pinged; err != nil && !errors.Is(err, ErrStreamed) {
+		t.Fatalf("Ping while switching: %v", err)
+	}
+	if s := d.DispatchStats(); s.Handled != 2 {
+		t.Fatalf("Unexpected dispatch stats %+v", s)
+	}
+	go crw.Write(([]byte)("hello pio"))
+	<-d.StreamedDone()
+	drw, err := d.AsStream()
+	if err != nil {
+		t.Fatalf("d.AsStream: %v", err)
+	}
+	buf := make([]byte, 9)
+	if _, err = io.ReadFull(drw, buf); err != nil {
+		t.Fatalf("d.stream.Read: %v", err)
+	}
+	if (string)(buf) != "hello pio" {
+		t.Fatalf("Read %q from the stream", buf)
+	}
+}
+
+func TestConnWorkersCloseWhileSwitching(t *testing.T){
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+	c, d := NewConn(ar, aw), NewConn(br, bw, WithWorkers(1, 1))
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	Handle(d, func(ctx context.Context, p *dataPkt)(error){
+		close(started)
+		<-release
+		return nil
+	})
+	served := make(chan error, 1)
+	go func(){
+		served <- d.Serve()
+	}()
+	go c.Serve()
+	defer c.Close()
+	<-c.ServeDone()
+
+	if err := c.Send(&dataPkt{}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	<-started
+	go c.AsStream()
+	// let d wait for the handler before the stream switch
+	time.Sleep(50 * time.Millisecond)
+	d.Close()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serve is not returned after Close")
+	}
+	// nothing is left waiting for the handler which is still running
+	buf := make([]byte, 1 << 20)
+	if stack := (string)(buf[:runtime.Stack(buf, true)]); strings.Contains(stack, "dispatcher).wait") {
+		t.Fatalf("A goroutine is left waiting for the handlers:\n%s", stack)
+	}
+}
+
+type chanTransport struct{
+	out, in chan []byte
+	stop chan struct{}
+	binding []byte
+}
+
+func (t *chanTransport)ChannelBinding()([]byte){
+	return t.binding
+}
+
+func (t *chanTransport)WriteMessage(msg []byte)(error){
+	t.out <- append([]byte{}, msg...)
+	return nil
+}
+
+func (t *chanTransport)ReadMessage()([]byte, error){
+	select {
+	case msg := <-t.in:
+		return msg, nil
+	case <-t.stop:
+		return nil, io.EOF
+	}
+}
+
+func TestHMACAuthRelay(t *testing.T){
+	stop := make(chan struct{})
+	defer close(stop)
+	newTransport := func()(*chanTransport){
+		return &chanTransport{out: make(chan []byte, 4), in: make(chan []byte, 4), stop: stop}
+	}
+	// the attacker opens two sessions to alice, and relays the messages of each session into the other one
+	a := &HMACAuth{Identity: "alice", Secret: []byte("shared secret")}
+	t1, t2 := newTransport(), newTransport()
+	res := make(chan error, 2)
+	for _, tr := range []*chanTransport{t1, t2} {
+		go func(tr *chanTransport){
+			_, err := a.Authenticate(tr)
+			res <- err
+		}(tr)
+	}
+	go func(){
+		for {
+			var m1, m2 []byte
+			select {
+			case m1 = <-t1.out:
+			case <-stop:
+				return
+			}
+			select {
+			case m2 = <-t2.out:
+			case <-stop:
+				return
+			}
+			t1.in <- m2
+			t2.in <- m1
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		var ae *AuthError
+		if err := <-res; !errors.As(err, &ae) {
+			t.Fatalf("Authenticate should reject the relayed session, got %v", err)
+		}
+	}
+}
+
+func TestHMACAuthChannelBinding(t *testing.T){
+	stop := make(chan struct{})
+	defer close(stop)
+	newTransport := func(binding string)(*chanTransport){
+		return &chanTransport{out: make(chan []byte, 4), in: make(chan []byte, 4), stop: stop, binding: ([]byte)(binding)}
+	}
+	alice := &HMACAuth{Identity: "alice", Secret: []byte("shared secret")}
+	bob := &HMACAuth{Identity: "bob", Secret: []byte("shared secret")}
+	for _, tc := range []struct{
+		name string
+		b1, b2 string
+		ok bool
+	}{
+		{"same-session", "session", "session", true},
+		// a man in the middle has a secure session with each side, and relays the messages between them
+		{"relayed", "session 1", "session 2", false},
+	}{
+		t.Run(tc.name, func(t *testing.T){
+			ta, tb := newTransport(tc.b1), newTransport(tc.b2)
+			go func(){
+				for {
+					select {
+					case m := <-ta.out:
+						tb.in <- m
+					case m := <-tb.out:
+						ta.in <- m
+					case <-stop:
+						return
+					}
+				}
+			}()
+			res := make(chan error, 2)
+			go func(){
+				_, err := alice.Authenticate(ta)
+				res <- err
+			}()
+			go func(){
+				_, err := bob.Authenticate(tb)
+				res <- err
+			}()
+			for i := 0; i < 2; i++ {
+				if err := <-res; (err == nil) != tc.ok {
+					t.Fatalf("Authenticate returned %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package pio
+
+import (
+	"context"
+)
+
+type (
+	// PacketContext is a Packet which handler receives the Conn that the packet arrived on.
+	// Conn.parser calls TriggerContext instead of Trigger if it's implemented
+	PacketContext interface{
+		PacketBase
+		TriggerContext(ctx context.Context, c *Conn)(error)
+	}
+
+	// PacketAskContext is the context aware version of PacketAsk, the returned packet is the response.
+	// Conn.parser calls AskContext instead of Ask if it's implemented
+	PacketAskContext interface{
+		PacketBase
+		AskContext(ctx context.Context, c *Conn)(PacketBase, error)
+	}
+)
+
+type handlerCtxKey struct{}
+
+type handlerInfo struct{
+	conn *Conn
+	id uint32
+}
+
+// handlerContext returns the context passed to the handlers of the packet with the request id,
+// it's cancelled when the Conn is closed or stops serving
+func (c *Conn)handlerContext(id uint32)(context.Context){
+	return context.WithValue(c.ctx, handlerCtxKey{}, &handlerInfo{conn: c, id: id})
+}
+
+// ConnFromContext returns the Conn that the handling packet arrived on, or nil if ctx is not a handler context
+func ConnFromContext(ctx context.Context)(*Conn){
+	if h, ok := ctx.Value(handlerCtxKey{}).(*handlerInfo); ok {
+		return h.conn
+	}
+	return nil
+}
+
+// RequestIdFromContext returns the request id of the handling packet,
+// it's zero if the packet is not sent by Ask. ok is false if ctx is not a handler context
+func RequestIdFromContext(ctx context.Context)(id uint32, ok bool){
+	var h *handlerInfo
+	if h, ok = ctx.Value(handlerCtxKey{}).(*handlerInfo); ok {
+		id = h.id
+	}
+	return
+}
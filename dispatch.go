@@ -0,0 +1,162 @@
+package pio
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// streamDrainTimeout is how long the stream switch waits for the dispatched handlers
+const streamDrainTimeout = 10 * time.Second
+
+// DispatchStats is the counters of the worker pool of a Conn, see WithWorkers
+type DispatchStats struct{
+	// Queued is the count of the packets which are waiting for a worker
+	Queued int64
+	// MaxQueued is the max value of Queued since the Conn is created
+	MaxQueued int64
+	// Running is the count of the running handlers
+	Running int64
+	// Handled is the count of the handlers that returned
+	Handled uint64
+}
+
+// dispatcher runs the handlers of the received packets in a bounded worker pool.
+// Every worker has its own queue for the ordered packets, and all workers share a queue for the others,
+// so the packets with the same order key always run on the same worker in the received order
+type dispatcher struct{
+	c *Conn
+	shared chan func()
+	queues []chan func()
+	orderKey func(p PacketBase)(key uint64, ok bool)
+	// pending counts the queued and running handlers, idle is closed when it drops to zero.
+	// They are not a WaitGroup, so wait can give up without leaving a goroutine blocked on it
+	pendmux sync.Mutex
+	pending int
+	idle chan struct{}
+	stats DispatchStats
+}
+
+func newDispatcher(c *Conn, workers int, queue int, orderKey func(PacketBase)(uint64, bool))(d *dispatcher){
+	d = &dispatcher{
+		c: c,
+		shared: make(chan func(), queue),
+		orderKey: orderKey,
+	}
+	if orderKey != nil {
+		d.queues = make([]chan func(), workers)
+		for i := range d.queues {
+			d.queues[i] = make(chan func(), queue)
+		}
+	}
+	return
+}
+
+// start starts the workers, they exit when the Conn is closed or stops serving
+func (d *dispatcher)start(workers int){
+	for i := 0; i < workers; i++ {
+		var own chan func()
+		if d.queues != nil {
+			own = d.queues[i]
+		}
+		go d.worker(own)
+	}
+}
+
+func (d *dispatcher)worker(own <-chan func()){
+	done := d.c.ctx.Done()
+	for {
+		var job func()
+		select {
+		case job = <-own:
+		case job = <-d.shared:
+		case <-done:
+			return
+		}
+		atomic.AddInt64(&d.stats.Queued, -1)
+		atomic.AddInt64(&d.stats.Running, 1)
+		job()
+		atomic.AddInt64(&d.stats.Running, -1)
+		atomic.AddUint64(&d.stats.Handled, 1)
+		d.done()
+	}
+}
+
+func (d *dispatcher)add(){
+	d.pendmux.Lock()
+	defer d.pendmux.Unlock()
+	if d.pending == 0 {
+		d.idle = make(chan struct{})
+	}
+	d.pending++
+}
+
+func (d *dispatcher)done(){
+	d.pendmux.Lock()
+	defer d.pendmux.Unlock()
+	d.pending--
+	if d.pending == 0 {
+		close(d.idle)
+	}
+}
+
+// dispatch queues the handler of the packet, it blocks while the queue is full
+func (d *dispatcher)dispatch(p PacketBase, job func())(error){
+	q := d.shared
+	if d.orderKey != nil {
+		if key, ok := d.orderKey(p); ok {
+			// mix the bits, so the keys which differ in the high bits still spread over the workers
+			key *= 0x9e3779b97f4a7c15
+			q = d.queues[(key >> 32) % (uint64)(len(d.queues))]
+		}
+	}
+	d.add()
+	n := atomic.AddInt64(&d.stats.Queued, 1)
+	for {
+		max := atomic.LoadInt64(&d.stats.MaxQueued)
+		if n <= max || atomic.CompareAndSwapInt64(&d.stats.MaxQueued, max, n) {
+			break
+		}
+	}
+	select {
+	case q <- job:
+		return nil
+	case <-d.c.ctx.Done():
+		atomic.AddInt64(&d.stats.Queued, -1)
+		d.done()
+		return d.c.ctx.Err()
+	}
+}
+
+// wait waits until all dispatched handlers returned, it reports false if they did not return in timeout
+func (d *dispatcher)wait(timeout time.Duration)(bool){
+	d.pendmux.Lock()
+	if d.pending == 0 {
+		d.pendmux.Unlock()
+		return true
+	}
+	idle := d.idle
+	d.pendmux.Unlock()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-idle:
+	case <-d.c.ctx.Done():
+	case <-timer.C:
+		return false
+	}
+	return true
+}
+
+// DispatchStats returns the counters of the worker pool, it's zero if the Conn does not use WithWorkers
+func (c *Conn)DispatchStats()(s DispatchStats){
+	if c.disp == nil {
+		return
+	}
+	return DispatchStats{
+		Queued: atomic.LoadInt64(&c.disp.stats.Queued),
+		MaxQueued: atomic.LoadInt64(&c.disp.stats.MaxQueued),
+		Running: atomic.LoadInt64(&c.disp.stats.Running),
+		Handled: atomic.LoadUint64(&c.disp.stats.Handled),
+	}
+}
@@ -0,0 +1,206 @@
+package encoding
+
+import (
+	"errors"
+	"io"
+)
+
+// The bits are packed from the least significant bit of a byte to the most significant bit,
+// and a field which is wider than the rest of the current byte continues at the least significant bit of the next byte,
+// with its lower bits first. The last byte is padded with zero bits.
+//
+// A packed bool slice is the length (the number of the bools) followed by ceil(length / 8) bytes of the packed bits.
+
+var ErrBitWidth = errors.New("encoding: bit width must be between 0 and 64")
+
+// BitWriter packs unsigned fields of 0 to 64 bits into bytes, Flush must be called after the last field
+type BitWriter struct{
+	w io.Writer
+	cur byte
+	n uint // the number of the used bits of cur
+	buf [8]byte
+	pending int
+}
+
+func NewBitWriter(w io.Writer)(*BitWriter){
+	return &BitWriter{
+		w: w,
+	}
+}
+
+// WriteBits writes the lower width bits of v
+func (b *BitWriter)WriteBits(v uint64, width uint)(err error){
+	if width > 64 {
+		return ErrBitWidth
+	}
+	if width < 64 {
+		v &= 1 << width - 1
+	}
+	for width > 0 {
+		m := 8 - b.n
+		if m > width {
+			m = width
+		}
+		b.cur |= (byte)(v & (1 << m - 1)) << b.n
+		b.n += m
+		v >>= m
+		width -= m
+		if b.n == 8 {
+			if err = b.putByte(b.cur); err != nil {
+				return
+			}
+			b.cur, b.n = 0, 0
+		}
+	}
+	return
+}
+
+func (b *BitWriter)putByte(v byte)(err error){
+	b.buf[b.pending] = v
+	b.pending++
+	if b.pending == len(b.buf) {
+		return b.flushBuf()
+	}
+	return
+}
+
+func (b *BitWriter)flushBuf()(err error){
+	if b.pending > 0 {
+		_, err = b.w.Write(b.buf[:b.pending])
+		b.pending = 0
+	}
+	return
+}
+
+func (b *BitWriter)WriteBit(v bool)(error){
+	if v {
+		return b.WriteBits(1, 1)
+	}
+	return b.WriteBits(0, 1)
+}
+
+func (b *BitWriter)WriteBools(v []bool)(err error){
+	for _, ok := range v {
+		if err = b.WriteBit(ok); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Flush pads the current byte with zero bits, and writes all pending bytes
+func (b *BitWriter)Flush()(err error){
+	if b.n > 0 {
+		if err = b.putByte(b.cur); err != nil {
+			return
+		}
+		b.cur, b.n = 0, 0
+	}
+	return b.flushBuf()
+}
+
+// BitReader reads the fields which are packed by BitWriter
+type BitReader struct{
+	r io.Reader
+	cur byte
+	n uint // the number of the unread bits of cur
+	buf [1]byte
+}
+
+func NewBitReader(r io.Reader)(*BitReader){
+	return &BitReader{
+		r: r,
+	}
+}
+
+// ReadBits reads a field of width bits
+func (b *BitReader)ReadBits(width uint)(v uint64, err error){
+	if width > 64 {
+		return 0, ErrBitWidth
+	}
+	var s uint
+	for s < width {
+		if b.n == 0 {
+			if _, err = io.ReadFull(b.r, b.buf[:]); err != nil {
+				if s > 0 && err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return
+			}
+			b.cur, b.n = b.buf[0], 8
+		}
+		m := b.n
+		if m > width - s {
+			m = width - s
+		}
+		v |= (uint64)(b.cur & (1 << m - 1)) << s
+		b.cur >>= m
+		b.n -= m
+		s += m
+	}
+	return
+}
+
+func (b *BitReader)ReadBit()(v bool, err error){
+	var n uint64
+	if n, err = b.ReadBits(1); err != nil {
+		return
+	}
+	return n != 0, nil
+}
+
+// ReadBools reads n bools
+func (b *BitReader)ReadBools(n int)(v []bool, err error){
+	v = make([]bool, n)
+	for i := range v {
+		if v[i], err = b.ReadBit(); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// Align discards the rest bits of the current byte, so the next field starts at a byte boundary
+func (b *BitReader)Align(){
+	b.cur, b.n = 0, 0
+}
+
+func packBools(v []bool)(buf []byte){
+	buf = make([]byte, (len(v) + 7) / 8)
+	for i, ok := range v {
+		if ok {
+			buf[i / 8] |= 1 << (i % 8)
+		}
+	}
+	return
+}
+
+func unpackBools(buf []byte, v []bool){
+	for i := range v {
+		v[i] = buf[i / 8] & (1 << (i % 8)) != 0
+	}
+}
+
+// WritePackedBools writes v with 8 bools per byte
+func WritePackedBools(w Writer, v []bool)(err error){
+	if err = w.WriteLength((uint32)(len(v))); err != nil {
+		return
+	}
+	_, err = w.Write(packBools(v))
+	return
+}
+
+// ReadPackedBools reads the bool slice written by WritePackedBools
+func ReadPackedBools(r Reader)(v []bool, err error){
+	var l uint32
+	if l, err = r.ReadLength(); err != nil {
+		return
+	}
+	var buf []byte
+	if buf, err = ReadN(r, ((int64)(l) + 7) / 8); err != nil {
+		return
+	}
+	v = make([]bool, l)
+	unpackBools(buf, v)
+	return
+}
@@ -3,9 +3,11 @@ package encoding
 
 import (
 	"bytes"
-	// "io"
+	"io"
 )
 
+// Buffer is a bytes.Buffer which is both a Reader and a Writer with the same options.
+// The methods which are defined by both bytes.Buffer and Reader or Writer use the Reader or Writer one
 type Buffer struct{
 	*bytes.Buffer
 	reader
@@ -15,11 +17,12 @@ type Buffer struct{
 var _ Reader = (*Buffer)(nil)
 var _ Writer = (*Buffer)(nil)
 
-func NewBuffer(buf []byte)(b *Buffer){
+func NewBuffer(buf []byte, opts ...Option)(b *Buffer){
+	o := newOptions(opts)
 	b = new(Buffer)
 	b.Buffer = bytes.NewBuffer(buf)
-	b.reader = reader{b.Buffer}
-	b.writer = writer{b.Buffer}
+	b.reader = reader{Reader: b.Buffer, opts: o}
+	b.writer = writer{Writer: b.Buffer, opts: o}
 	return
 }
 
@@ -27,6 +30,10 @@ func (b *Buffer)Close()(error){
 	return nil
 }
 
+func (b *Buffer)Read(buf []byte)(n int, err error){
+	return b.reader.Read(buf)
+}
+
 func (b *Buffer)ReadByte()(v byte, err error){
 	return b.reader.ReadByte()
 }
@@ -39,6 +46,53 @@ func (b *Buffer)ReadBytes()(v []byte, err error){
 	return b.reader.ReadBytes()
 }
 
+// Peek returns the next n bytes of the buffer without copying, the result is only valid until the next modification
+func (b *Buffer)Peek(n int)(buf []byte, err error){
+	if n < 0 {
+		panic("encoding: negative peek count")
+	}
+	if err = b.reader.checkTotal((int64)(n)); err != nil {
+		return
+	}
+	buf = b.Buffer.Bytes()
+	if len(buf) < n {
+		if len(buf) == 0 {
+			return buf, io.EOF
+		}
+		return buf, io.ErrUnexpectedEOF
+	}
+	return buf[:n:n], nil
+}
+
+func (b *Buffer)Skip(n int64)(err error){
+	if n < 0 {
+		panic("encoding: negative skip count")
+	}
+	if err = b.reader.checkTotal(n); err != nil {
+		return
+	}
+	if l := (int64)(b.Buffer.Len()); n > l {
+		b.Buffer.Reset()
+		b.reader.n += l
+		return io.ErrUnexpectedEOF
+	}
+	b.Buffer.Next((int)(n))
+	b.reader.n += n
+	return
+}
+
+func (b *Buffer)SkipBytes()(err error){
+	var l uint32
+	if l, err = b.reader.readPrefix(); err != nil {
+		return
+	}
+	return b.Skip((int64)(l))
+}
+
+func (b *Buffer)Write(buf []byte)(n int, err error){
+	return b.writer.Write(buf)
+}
+
 func (b *Buffer)WriteByte(v byte)(err error){
 	return b.writer.WriteByte(v)
 }
@@ -0,0 +1,147 @@
+package encoding
+
+import (
+	"unsafe"
+)
+
+// preallocLimit is the max element count the read helpers allocate before the elements are decoded
+const preallocLimit = 1024
+
+// preallocLen returns the capacity allocated for l elements of size bytes before they are decoded,
+// it's bounded by preallocLimit and readChunk, so a wrong length prefix cannot allocate the memory at once
+func preallocLen(l uint32, size uintptr)(int){
+	n := (uintptr)(l)
+	if n > preallocLimit {
+		n = preallocLimit
+	}
+	if size > 0 && n > readChunk / size {
+		n = readChunk / size
+	}
+	return (int)(n)
+}
+
+// PreallocCap returns the capacity to allocate for a slice of l elements before the elements are decoded,
+// it's used by the generated code to bound the memory that a wrong length prefix allocates
+func PreallocCap[T any](l uint32)(int){
+	return preallocLen(l, unsafe.Sizeof(*new(T)))
+}
+
+// PreallocMapCap is the map version of PreallocCap
+func PreallocMapCap[K comparable, V any](l uint32)(int){
+	return preallocLen(l, unsafe.Sizeof(*new(K)) + unsafe.Sizeof(*new(V)))
+}
+
+// WriteSlice writes the length prefix and then each element by enc.
+// Method expressions can be used as enc directly, e.g. Writer.WriteString
+func WriteSlice[T any](w Writer, v []T, enc func(Writer, T)(error))(err error){
+	if err = w.WriteLength((uint32)(len(v))); err != nil {
+		return
+	}
+	for _, e := range v {
+		if err = enc(w, e); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// ReadSlice reads a slice written by WriteSlice, e.g. ReadSlice(r, Reader.ReadString)
+func ReadSlice[T any](r Reader, dec func(Reader)(T, error))(v []T, err error){
+	var l uint32
+	if l, err = r.ReadLength(); err != nil {
+		return
+	}
+	v = make([]T, 0, PreallocCap[T](l))
+	for i := (uint32)(0); i < l; i++ {
+		var e T
+		if e, err = dec(r); err != nil {
+			return nil, err
+		}
+		v = append(v, e)
+	}
+	return
+}
+
+// WriteMap writes the length prefix and then each key value pair, the pairs are not sorted
+func WriteMap[K comparable, V any](w Writer, m map[K]V, encKey func(Writer, K)(error), encVal func(Writer, V)(error))(err error){
+	if err = w.WriteLength((uint32)(len(m))); err != nil {
+		return
+	}
+	for k, v := range m {
+		if err = encKey(w, k); err != nil {
+			return
+		}
+		if err = encVal(w, v); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func ReadMap[K comparable, V any](r Reader, decKey func(Reader)(K, error), decVal func(Reader)(V, error))(m map[K]V, err error){
+	var l uint32
+	if l, err = r.ReadLength(); err != nil {
+		return
+	}
+	m = make(map[K]V, PreallocMapCap[K, V](l))
+	for i := (uint32)(0); i < l; i++ {
+		var (
+			k K
+			v V
+		)
+		if k, err = decKey(r); err != nil {
+			return nil, err
+		}
+		if v, err = decVal(r); err != nil {
+			return nil, err
+		}
+		m[k] = v
+	}
+	return
+}
+
+// Optional is a value which may be absent, it's encoded as a presence byte followed by the value if it's valid
+type Optional[T any] struct{
+	Value T
+	Valid bool
+}
+
+func Some[T any](v T)(Optional[T]){
+	return Optional[T]{
+		Value: v,
+		Valid: true,
+	}
+}
+
+// Get returns the value and whether it's valid
+func (o Optional[T])Get()(T, bool){
+	return o.Value, o.Valid
+}
+
+func WriteOptional[T any](w Writer, v Optional[T], enc func(Writer, T)(error))(err error){
+	if err = w.WriteBool(v.Valid); err != nil || !v.Valid {
+		return
+	}
+	return enc(w, v.Value)
+}
+
+func ReadOptional[T any](r Reader, dec func(Reader)(T, error))(v Optional[T], err error){
+	if v.Valid, err = r.ReadBool(); err != nil || !v.Valid {
+		return
+	}
+	if v.Value, err = dec(r); err != nil {
+		return Optional[T]{}, err
+	}
+	return
+}
+
+// Encode is an enc function for the helpers which writes the value by its WriteTo method
+func Encode[T Marshaler](w Writer, v T)(error){
+	return v.WriteTo(w)
+}
+
+// Decode is a dec function for the helpers which reads the value by the ParseFrom method of *T
+func Decode[T any, P interface{ *T; Unmarshaler }](r Reader)(v T, err error){
+	err = (P)(&v).ParseFrom(r)
+	return
+}
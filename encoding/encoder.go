@@ -39,6 +39,18 @@ func EncodeFloat64(buf []byte, v float64)([]byte){
 	return EncodeUint64(buf, math.Float64bits(v))
 }
 
+func EncodeInt16(buf []byte, v int16)([]byte){
+	return EncodeUint16(buf, (uint16)(v))
+}
+
+func EncodeInt32(buf []byte, v int32)([]byte){
+	return EncodeUint32(buf, (uint32)(v))
+}
+
+func EncodeInt64(buf []byte, v int64)([]byte){
+	return EncodeUint64(buf, (uint64)(v))
+}
+
 
 func DecodeUint16(buf []byte)(uint16){
 	return (uint16)(buf[0]) | (uint16)(buf[1]) << 8
@@ -64,6 +76,18 @@ func DecodeFloat64(buf []byte)(float64){
 	return math.Float64frombits(DecodeUint64(buf))
 }
 
+func DecodeInt16(buf []byte)(int16){
+	return (int16)(DecodeUint16(buf))
+}
+
+func DecodeInt32(buf []byte)(int32){
+	return (int32)(DecodeUint32(buf))
+}
+
+func DecodeInt64(buf []byte)(int64){
+	return (int64)(DecodeUint64(buf))
+}
+
 
 func EncodeUint16s(buf []byte, v []uint16)([]byte){
 	for i, n := range v {
@@ -100,6 +124,27 @@ func EncodeFloat64s(buf []byte, v []float64)([]byte){
 	return buf
 }
 
+func EncodeInt16s(buf []byte, v []int16)([]byte){
+	for i, n := range v {
+		EncodeInt16(buf[i * 2:], n)
+	}
+	return buf
+}
+
+func EncodeInt32s(buf []byte, v []int32)([]byte){
+	for i, n := range v {
+		EncodeInt32(buf[i * 4:], n)
+	}
+	return buf
+}
+
+func EncodeInt64s(buf []byte, v []int64)([]byte){
+	for i, n := range v {
+		EncodeInt64(buf[i * 8:], n)
+	}
+	return buf
+}
+
 func DecodeUint16s(buf []byte)(v []uint16){
 	v = make([]uint16, len(buf) / 2)
 	for i, _ := range v {
@@ -140,3 +185,97 @@ func DecodeFloat64s(buf []byte)(v []float64){
 	return
 }
 
+
+func DecodeInt16s(buf []byte)(v []int16){
+	v = make([]int16, len(buf) / 2)
+	for i, _ := range v {
+		v[i] = DecodeInt16(buf[i * 2:])
+	}
+	return
+}
+
+func DecodeInt32s(buf []byte)(v []int32){
+	v = make([]int32, len(buf) / 4)
+	for i, _ := range v {
+		v[i] = DecodeInt32(buf[i * 4:])
+	}
+	return
+}
+
+func DecodeInt64s(buf []byte)(v []int64){
+	v = make([]int64, len(buf) / 8)
+	for i, _ := range v {
+		v[i] = DecodeInt64(buf[i * 8:])
+	}
+	return
+}
+
+
+// MaxVarintLen is the maximum length of a varint encoded 64-bit integer
+const MaxVarintLen = 10
+
+// EncodeVarUint encodes v as LEB128 into buf, and returns the used part of buf.
+// buf must have at least MaxVarintLen bytes
+func EncodeVarUint(buf []byte, v uint64)([]byte){
+	i := 0
+	for v >= 0x80 {
+		buf[i] = (byte)(v) | 0x80
+		v >>= 7
+		i++
+	}
+	buf[i] = (byte)(v)
+	return buf[:i + 1]
+}
+
+// EncodeVarInt encodes v as zigzag LEB128 into buf, and returns the used part of buf
+func EncodeVarInt(buf []byte, v int64)([]byte){
+	return EncodeVarUint(buf, ZigZag(v))
+}
+
+// DecodeVarUint decodes a LEB128 integer from buf,
+// n is the count of bytes used, or 0 if buf is too short, or negative if it overflows 64 bits
+func DecodeVarUint(buf []byte)(v uint64, n int){
+	var s uint
+	for i, b := range buf {
+		if i == MaxVarintLen {
+			return 0, -(i + 1)
+		}
+		if b < 0x80 {
+			if i == MaxVarintLen - 1 && b > 1 {
+				return 0, -(i + 1)
+			}
+			return v | (uint64)(b) << s, i + 1
+		}
+		v |= (uint64)(b & 0x7f) << s
+		s += 7
+	}
+	return 0, 0
+}
+
+func DecodeVarInt(buf []byte)(v int64, n int){
+	u, n := DecodeVarUint(buf)
+	return UnZigZag(u), n
+}
+
+func ZigZag(v int64)(uint64){
+	return (uint64)(v << 1) ^ (uint64)(v >> 63)
+}
+
+func UnZigZag(v uint64)(int64){
+	return (int64)(v >> 1) ^ -(int64)(v & 1)
+}
+
+func encodeSlice[T any](buf []byte, v []T, size int, put func([]byte, T))([]byte){
+	for i, n := range v {
+		put(buf[i * size:], n)
+	}
+	return buf
+}
+
+func decodeSlice[T any](buf []byte, size int, get func([]byte)(T))(v []T){
+	v = make([]T, len(buf) / size)
+	for i, _ := range v {
+		v[i] = get(buf[i * size:])
+	}
+	return
+}
@@ -0,0 +1,634 @@
+package encoding_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	. "github.com/kmcsr/go-pio/encoding"
+)
+
+type marshalInner struct{
+	Name string
+	Values []uint32
+}
+
+type marshalSample struct{
+	A uint8
+	B int16
+	C int64 `pio:"order=-1"`
+	D float64
+	E bool
+	Skipped string `pio:"-"`
+	Magic string `pio:"size=4"`
+	Raw []byte
+	Inner marshalInner
+	List []marshalInner
+	Opt *marshalInner
+	Nil *marshalInner
+	Arr [3]int32
+	Map map[string]uint16
+	private int
+}
+
+func TestMarshal(t *testing.T){
+	v := marshalSample{
+		A: 0xf1,
+		B: -2,
+		C: -1 << 40,
+		D: 3.5,
+		E: true,
+		Skipped: "skip",
+		Magic: "PIO1",
+		Raw: []byte{1, 2, 3},
+		Inner: marshalInner{"inner", []uint32{1, 2}},
+		List: []marshalInner{{"a", nil}, {"b", []uint32{3}}},
+		Opt: &marshalInner{Name: "opt", Values: []uint32{}},
+		Arr: [3]int32{-1, 0, 1},
+		Map: map[string]uint16{"x": 1, "y": 2},
+		private: 1,
+	}
+	buf := NewBuffer(nil)
+	if err := Marshal(buf, &v); err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var u marshalSample
+	if err := Unmarshal(buf, &u); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("%d bytes left after Unmarshal", buf.Len())
+	}
+	v.Skipped, v.private = "", 0
+	v.List[0].Values = []uint32{}
+	if !reflect.DeepEqual(v, u) {
+		t.Errorf("Unmarshal result not same:\n  want %#v\n  got  %#v", v, u)
+	}
+
+	v.Magic = "PIO"
+	if err := Marshal(NewBuffer(nil), &v); err == nil {
+		t.Errorf("Marshal with wrong fixed size should fail")
+	}
+}
+
+func TestVarint(t *testing.T){
+	uints := []uint64{0, 1, 0x7f, 0x80, 0x3fff, 0x4000, 1 << 32, 1<<64 - 1}
+	ints := []int64{0, -1, 1, -64, 64, -1 << 63, 1<<63 - 1}
+	buf := NewBuffer(nil)
+	for _, v := range uints {
+		buf.WriteVarUint(v)
+	}
+	for _, v := range ints {
+		buf.WriteVarInt(v)
+	}
+	for _, v := range uints {
+		if u, err := buf.ReadVarUint(); err != nil || u != v {
+			t.Errorf("ReadVarUint: want %d, got %d, %v", v, u, err)
+		}
+	}
+	for _, v := range ints {
+		if u, err := buf.ReadVarInt(); err != nil || u != v {
+			t.Errorf("ReadVarInt: want %d, got %d, %v", v, u, err)
+		}
+	}
+
+	buf = NewBuffer([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02})
+	if _, err := buf.ReadVarUint(); err != ErrVarintOverflow {
+		t.Errorf("ReadVarUint overflow: got %v", err)
+	}
+
+	buf = NewBuffer(nil, WithVarintLength())
+	buf.WriteString("pio")
+	buf.WriteUint32s([]uint32{1, 2})
+	if buf.Len() != 1 + 3 + 1 + 8 {
+		t.Errorf("varint length prefixed size is %d", buf.Len())
+	}
+	if s, err := buf.ReadString(); err != nil || s != "pio" {
+		t.Errorf("ReadString: got %q, %v", s, err)
+	}
+	if s, err := buf.ReadUint32s(); err != nil || len(s) != 2 || s[1] != 2 {
+		t.Errorf("ReadUint32s: got %v, %v", s, err)
+	}
+}
+
+func TestSignedInts(t *testing.T){
+	buf := NewBuffer(nil)
+	buf.WriteInt8(-8)
+	buf.WriteInt16(-16)
+	buf.WriteInt32(-32)
+	buf.WriteInt64(-64)
+	buf.WriteInt8s([]int8{-1, 1})
+	buf.WriteInt16s([]int16{-1, 1})
+	buf.WriteInt32s([]int32{-1, 1})
+	buf.WriteInt64s([]int64{-1, 1})
+	if v, err := buf.ReadInt8(); err != nil || v != -8 {
+		t.Errorf("ReadInt8: got %d, %v", v, err)
+	}
+	if v, err := buf.ReadInt16(); err != nil || v != -16 {
+		t.Errorf("ReadInt16: got %d, %v", v, err)
+	}
+	if v, err := buf.ReadInt32(); err != nil || v != -32 {
+		t.Errorf("ReadInt32: got %d, %v", v, err)
+	}
+	if v, err := buf.ReadInt64(); err != nil || v != -64 {
+		t.Errorf("ReadInt64: got %d, %v", v, err)
+	}
+	if v, err := buf.ReadInt8s(); err != nil || !reflect.DeepEqual(v, []int8{-1, 1}) {
+		t.Errorf("ReadInt8s: got %v, %v", v, err)
+	}
+	if v, err := buf.ReadInt16s(); err != nil || !reflect.DeepEqual(v, []int16{-1, 1}) {
+		t.Errorf("ReadInt16s: got %v, %v", v, err)
+	}
+	if v, err := buf.ReadInt32s(); err != nil || !reflect.DeepEqual(v, []int32{-1, 1}) {
+		t.Errorf("ReadInt32s: got %v, %v", v, err)
+	}
+	if v, err := buf.ReadInt64s(); err != nil || !reflect.DeepEqual(v, []int64{-1, 1}) {
+		t.Errorf("ReadInt64s: got %v, %v", v, err)
+	}
+}
+
+func TestByteOrder(t *testing.T){
+	buf := NewBuffer(nil, WithByteOrder(binary.BigEndian))
+	buf.WriteUint32(0x01020304)
+	buf.WriteInt16s([]int16{-2})
+	buf.WriteFloat64(1)
+	want := []byte{1, 2, 3, 4, 0, 0, 0, 1, 0xff, 0xfe, 0x3f, 0xf0, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("big endian bytes:\n  want %v\n  got  %v", want, buf.Bytes())
+	}
+	if v, err := buf.ReadUint32(); err != nil || v != 0x01020304 {
+		t.Errorf("ReadUint32: got %#x, %v", v, err)
+	}
+	if v, err := buf.ReadInt16s(); err != nil || len(v) != 1 || v[0] != -2 {
+		t.Errorf("ReadInt16s: got %v, %v", v, err)
+	}
+	if v, err := buf.ReadFloat64(); err != nil || v != 1 {
+		t.Errorf("ReadFloat64: got %v, %v", v, err)
+	}
+}
+
+func TestLimits(t *testing.T){
+	src := NewBuffer(nil)
+	src.WriteUint32(0xffffffff)
+	r := WrapReader(bytes.NewReader(src.Bytes()), WithLimits(Limits{MaxBytesLen: 1024}))
+	var le *LimitError
+	if _, err := r.ReadBytes(); !errors.As(err, &le) || le.Limit != "MaxBytesLen" {
+		t.Errorf("ReadBytes should fail with MaxBytesLen, got %v", err)
+	}
+	r = WrapReader(bytes.NewReader(src.Bytes()), WithLimits(Limits{MaxSliceLen: 1024}))
+	if _, err := r.ReadUint64s(); !errors.As(err, &le) || le.Limit != "MaxSliceLen" {
+		t.Errorf("ReadUint64s should fail with MaxSliceLen, got %v", err)
+	}
+	r = WrapReader(bytes.NewReader(src.Bytes()))
+	if _, err := r.ReadBytes(); err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadBytes with a short input should fail with io.ErrUnexpectedEOF, got %v", err)
+	}
+
+	src = NewBuffer(nil)
+	src.WriteString("hello")
+	src.WriteUint64(1)
+	r = WrapReader(bytes.NewReader(src.Bytes()), WithLimits(Limits{MaxTotalBytes: 12}))
+	if _, err := r.ReadString(); err != nil {
+		t.Fatalf("ReadString: %v", err)
+	}
+	if _, err := r.ReadUint64(); !errors.As(err, &le) || le.Limit != "MaxTotalBytes" {
+		t.Errorf("ReadUint64 should fail with MaxTotalBytes, got %v", err)
+	}
+}
+
+func TestSliceReader(t *testing.T){
+	src := NewBuffer(nil)
+	src.WriteUint32(7)
+	src.WriteBytes([]byte("payload"))
+	src.WriteString("str")
+	src.WriteUint16(1)
+	buf := src.Bytes()
+
+	r := NewSliceReader(buf, WithUnsafeString())
+	allocs := testing.AllocsPerRun(10, func(){
+		r.Reset(buf)
+		if v, err := r.ReadUint32(); err != nil || v != 7 {
+			t.Fatalf("ReadUint32: got %d, %v", v, err)
+		}
+		v, err := r.ReadBytesView()
+		if err != nil || (string)(v) != "payload" {
+			t.Fatalf("ReadBytesView: got %q, %v", v, err)
+		}
+		if &v[0] != &buf[8] {
+			t.Fatalf("ReadBytesView should not copy")
+		}
+		if s, err := r.ReadString(); err != nil || s != "str" {
+			t.Fatalf("ReadString: got %q, %v", s, err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("SliceReader allocated %v times", allocs)
+	}
+	if r.Offset() != len(buf) - 2 || r.Remaining() != 2 {
+		t.Errorf("Offset: %d, Remaining: %d", r.Offset(), r.Remaining())
+	}
+	if err := r.Skip(3); err != io.ErrUnexpectedEOF {
+		t.Errorf("Skip over the end should fail with io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+type containerElem struct{
+	Id uint32
+}
+
+func (e *containerElem)WriteTo(w Writer)(error){ return w.WriteUint32(e.Id) }
+func (e *containerElem)ParseFrom(r Reader)(err error){
+	e.Id, err = r.ReadUint32()
+	return
+}
+
+func TestContainers(t *testing.T){
+	buf := NewBuffer(nil)
+	strs := []string{"a", "bc"}
+	elems := []*containerElem{{1}, {2}}
+	m := map[string]int32{"x": -1, "y": 2}
+	if err := WriteSlice(buf, strs, Writer.WriteString); err != nil {
+		t.Fatalf("WriteSlice: %v", err)
+	}
+	if err := WriteSlice(buf, elems, Encode[*containerElem]); err != nil {
+		t.Fatalf("WriteSlice: %v", err)
+	}
+	if err := WriteMap(buf, m, Writer.WriteString, Writer.WriteInt32); err != nil {
+		t.Fatalf("WriteMap: %v", err)
+	}
+	WriteOptional(buf, Some[uint16](7), Writer.WriteUint16)
+	WriteOptional(buf, Optional[uint16]{}, Writer.WriteUint16)
+
+	if v, err := ReadSlice(buf, Reader.ReadString); err != nil || !reflect.DeepEqual(v, strs) {
+		t.Errorf("ReadSlice: got %v, %v", v, err)
+	}
+	if v, err := ReadSlice(buf, Decode[containerElem]); err != nil || !reflect.DeepEqual(v, []containerElem{{1}, {2}}) {
+		t.Errorf("ReadSlice: got %v, %v", v, err)
+	}
+	if v, err := ReadMap(buf, Reader.ReadString, Reader.ReadInt32); err != nil || !reflect.DeepEqual(v, m) {
+		t.Errorf("ReadMap: got %v, %v", v, err)
+	}
+	if v, err := ReadOptional(buf, Reader.ReadUint16); err != nil || v != Some[uint16](7) {
+		t.Errorf("ReadOptional: got %v, %v", v, err)
+	}
+	if v, err := ReadOptional(buf, Reader.ReadUint16); err != nil || v.Valid {
+		t.Errorf("ReadOptional: got %v, %v", v, err)
+	}
+}
+
+type stdSample struct{
+	Time time.Time
+	Dur time.Duration
+	Int big.Int
+	Float *big.Float
+	IP net.IP
+	Addr netip.AddrPort
+	Id UUID
+}
+
+func TestStdTypes(t *testing.T){
+	f, _, _ := big.ParseFloat("-1.25e-300", 10, 200, big.ToZero)
+	n, _ := new(big.Int).SetString("-123456789012345678901234567890", 10)
+	v := stdSample{
+		Time: time.Date(1960, 2, 3, 4, 5, 6, 7, time.UTC),
+		Dur: -time.Hour,
+		Int: *n,
+		Float: f,
+		IP: net.ParseIP("10.0.0.1"),
+		Addr: netip.MustParseAddrPort("[fe80::1%eth0]:8080"),
+		Id: UUID{1, 2, 3, 15: 0xff},
+	}
+	buf := NewBuffer(nil)
+	if err := Marshal(buf, &v); err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var u stdSample
+	if err := Unmarshal(buf, &u); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if !u.Time.Equal(v.Time) || u.Dur != v.Dur || u.Int.Cmp(&v.Int) != 0 || u.Addr != v.Addr || u.Id != v.Id {
+		t.Errorf("Unmarshal result not same:\n  want %v\n  got  %v", v, u)
+	}
+	if u.Float.Cmp(f) != 0 || u.Float.Prec() != 200 || u.Float.Mode() != big.ToZero {
+		t.Errorf("big.Float not same: want %v, got %v", f, u.Float)
+	}
+	if !u.IP.Equal(v.IP) || len(u.IP) != 4 {
+		t.Errorf("IP not same: want %v, got %v", v.IP, u.IP)
+	}
+
+	buf.Reset()
+	WriteBigFloat(buf, new(big.Float).SetInf(true))
+	if g, err := ReadBigFloat(buf); err != nil || !g.IsInf() || g.Sign() >= 0 {
+		t.Errorf("ReadBigFloat: got %v, %v", g, err)
+	}
+}
+
+func TestStream(t *testing.T){
+	data := bytes.Repeat(([]byte)("pio stream "), 20000)
+	buf := NewBuffer(nil, WithVarintLength())
+	if err := buf.WriteBytesFrom(bytes.NewReader(data), (int64)(len(data))); err != nil {
+		t.Fatalf("WriteBytesFrom: %v", err)
+	}
+	if err := buf.WriteBytesFrom(bytes.NewReader(data[:4]), 4); err != nil {
+		t.Fatalf("WriteBytesFrom: %v", err)
+	}
+	if err := buf.WriteUint16(0xabcd); err != nil {
+		t.Fatalf("WriteUint16: %v", err)
+	}
+
+	var out bytes.Buffer
+	if n, err := buf.ReadBytesTo(&out); err != nil || n != (int64)(len(data)) || !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("ReadBytesTo returned %d, %v", n, err)
+	}
+	lr, err := buf.ReadBytesReader()
+	if err != nil || lr.N != 4 {
+		t.Fatalf("ReadBytesReader returned %v, %v", lr, err)
+	}
+	if v, err := io.ReadAll(lr); err != nil || (string)(v) != "pio " {
+		t.Fatalf("Read view returned %q, %v", v, err)
+	}
+	if v, err := buf.ReadUint16(); err != nil || v != 0xabcd {
+		t.Fatalf("ReadUint16 after the stream returned %x, %v", v, err)
+	}
+
+	if err := NewBuffer(nil).WriteBytesFrom(bytes.NewReader(data[:4]), 8); err != io.ErrUnexpectedEOF {
+		t.Fatalf("WriteBytesFrom a short reader should return io.ErrUnexpectedEOF, got %v", err)
+	}
+	short := NewBuffer(nil)
+	short.WriteLength(8)
+	short.Write(data[:4])
+	if _, err := short.ReadBytesTo(io.Discard); err != io.ErrUnexpectedEOF {
+		t.Fatalf("ReadBytesTo a short value should return io.ErrUnexpectedEOF, got %v", err)
+	}
+	limited := NewBuffer(nil, WithLimits(Limits{MaxBytesLen: 16}))
+	limited.WriteBytesFrom(bytes.NewReader(data), 32)
+	var le *LimitError
+	if _, err := limited.ReadBytesReader(); !errors.As(err, &le) {
+		t.Fatalf("ReadBytesReader should return LimitError, got %v", err)
+	}
+}
+
+type packedStruct struct{
+	Flags []bool `pio:"packed"`
+	Fixed [10]bool `pio:"packed"`
+	N uint8
+}
+
+func TestBits(t *testing.T){
+	var out bytes.Buffer
+	bw := NewBitWriter(&out)
+	bw.WriteBits(5, 3)
+	bw.WriteBit(true)
+	bw.WriteBits(0x1abc, 13)
+	bw.WriteBits(0xfedcba9876543210, 64)
+	if err := bw.WriteBits(0, 65); err != ErrBitWidth {
+		t.Fatalf("WriteBits 65 bits should return ErrBitWidth, got %v", err)
+	}
+	if err := bw.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if out.Len() != 11 {
+		t.Fatalf("81 bits should be packed into 11 bytes, got %d", out.Len())
+	}
+	if out.Bytes()[0] != 0xcd {
+		t.Fatalf("Unexpected first byte %#02x", out.Bytes()[0])
+	}
+	br := NewBitReader(bytes.NewReader(out.Bytes()))
+	for _, f := range []struct{ v uint64; w uint }{{5, 3}, {1, 1}, {0x1abc, 13}, {0xfedcba9876543210, 64}} {
+		if v, err := br.ReadBits(f.w); err != nil || v != f.v {
+			t.Fatalf("ReadBits(%d) returned %#x, %v, expect %#x", f.w, v, err, f.v)
+		}
+	}
+	br.Align()
+	if _, err := br.ReadBit(); err != io.EOF {
+		t.Fatalf("ReadBit after the padding should return io.EOF, got %v", err)
+	}
+	br = NewBitReader(bytes.NewReader([]byte{0xff}))
+	if _, err := br.ReadBits(9); err != io.ErrUnexpectedEOF {
+		t.Fatalf("ReadBits across the end should return io.ErrUnexpectedEOF, got %v", err)
+	}
+
+	bools := make([]bool, 100)
+	for i := range bools {
+		bools[i] = i % 3 == 0
+	}
+	buf := NewBuffer(nil)
+	if err := WritePackedBools(buf, bools); err != nil {
+		t.Fatalf("WritePackedBools: %v", err)
+	}
+	if buf.Len() != 4 + 13 {
+		t.Fatalf("100 packed bools should take 17 bytes, got %d", buf.Len())
+	}
+	if v, err := ReadPackedBools(buf); err != nil || !reflect.DeepEqual(v, bools) {
+		t.Fatalf("ReadPackedBools returned %v, %v", v, err)
+	}
+	// the packed bytes are larger than a read chunk
+	many := make([]bool, 600000)
+	for i := range many {
+		many[i] = i % 7 == 0
+	}
+	buf = NewBuffer(nil)
+	if err := WritePackedBools(buf, many); err != nil {
+		t.Fatalf("WritePackedBools: %v", err)
+	}
+	if v, err := ReadPackedBools(buf); err != nil || !reflect.DeepEqual(v, many) {
+		t.Fatalf("ReadPackedBools of %d bools returned %d bools, %v", len(many), len(v), err)
+	}
+	if _, err := ReadPackedBools(NewBuffer([]byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3})); err != io.ErrUnexpectedEOF {
+		t.Fatalf("ReadPackedBools of a huge length should return io.ErrUnexpectedEOF, got %v", err)
+	}
+
+	in := &packedStruct{Flags: bools[:11], N: 7}
+	in.Fixed[0], in.Fixed[9] = true, true
+	buf = NewBuffer(nil)
+	if err := Marshal(buf, in); err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if buf.Len() != 4 + 2 + 2 + 1 {
+		t.Fatalf("Unexpected packed struct size %d", buf.Len())
+	}
+	var got packedStruct
+	if err := Unmarshal(buf, &got); err != nil || !reflect.DeepEqual(&got, in) {
+		t.Fatalf("Unmarshal returned %+v, %v", got, err)
+	}
+}
+
+type onlyReader struct{
+	io.Reader
+}
+
+func TestPeekSkip(t *testing.T){
+	src := NewBuffer(nil, WithVarintLength())
+	src.WriteUint32(0x01020304)
+	src.WriteString("unknown field")
+	src.WriteUint16s([]uint16{1, 2, 3})
+	src.WriteByte(0xee)
+	if n := src.BytesWritten(); n != 4 + 1 + 13 + 1 + 6 + 1 {
+		t.Fatalf("BytesWritten returned %d", n)
+	}
+	data := src.Bytes()
+
+	readers := map[string]Reader{
+		"reader": WrapReader(onlyReader{bytes.NewReader(data)}, WithVarintLength()),
+		"slice": NewSliceReader(data, WithVarintLength()),
+		"buffer": NewBuffer(append([]byte{}, data...), WithVarintLength()),
+	}
+	for name, r := range readers {
+		head, err := r.Peek(4)
+		if err != nil || !bytes.Equal(head, data[:4]) {
+			t.Fatalf("%s: Peek returned %v, %v", name, head, err)
+		}
+		if v, err := r.ReadUint32(); err != nil || v != 0x01020304 {
+			t.Fatalf("%s: ReadUint32 after Peek returned %x, %v", name, v, err)
+		}
+		if err := r.SkipBytes(); err != nil {
+			t.Fatalf("%s: SkipBytes: %v", name, err)
+		}
+		if l, err := r.ReadLength(); err != nil || l != 3 {
+			t.Fatalf("%s: ReadLength returned %d, %v", name, l, err)
+		}
+		if err := r.Skip(6); err != nil {
+			t.Fatalf("%s: Skip: %v", name, err)
+		}
+		if n := r.BytesRead(); n != (int64)(len(data)) - 1 {
+			t.Fatalf("%s: BytesRead returned %d", name, n)
+		}
+		if rest, err := r.Peek(2); err != io.ErrUnexpectedEOF || !bytes.Equal(rest, []byte{0xee}) {
+			t.Fatalf("%s: Peek beyond the end returned %v, %v", name, rest, err)
+		}
+		if err := r.Skip(2); err != io.ErrUnexpectedEOF {
+			t.Fatalf("%s: Skip beyond the end should return io.ErrUnexpectedEOF, got %v", name, err)
+		}
+		if _, err := r.Peek(1); err != io.EOF {
+			t.Fatalf("%s: Peek at the end should return io.EOF, got %v", name, err)
+		}
+	}
+
+	limited := WrapReader(bytes.NewReader(data), WithLimits(Limits{MaxTotalBytes: 8}))
+	var le *LimitError
+	if err := limited.Skip(9); !errors.As(err, &le) {
+		t.Fatalf("Skip over MaxTotalBytes should return LimitError, got %v", err)
+	}
+}
+
+type (
+	nestedV1 struct{
+		Name string
+	}
+	nestedV2 struct{
+		Name string
+		Extra []uint32
+	}
+	outerV1 struct{
+		Inner nestedV1 `pio:"message"`
+		Tail uint16
+	}
+	outerV2 struct{
+		Inner nestedV2 `pio:"message"`
+		Tail uint16
+	}
+)
+
+func TestMessage(t *testing.T){
+	buf := NewBuffer(nil, WithVarintLength())
+	err := buf.WriteMessage(func(w Writer)(err error){
+		if err = w.WriteUint32(7); err != nil {
+			return
+		}
+		return w.WriteString("newer field")
+	})
+	if err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+	failed := errors.New("failed")
+	if err := buf.WriteMessage(func(w Writer)(error){
+		w.WriteUint64(1)
+		return failed
+	}); err != failed {
+		t.Fatalf("WriteMessage should return the error of fn, got %v", err)
+	}
+	buf.WriteByte(0xee)
+	data := buf.Bytes()
+
+	for name, r := range map[string]Reader{
+		"buffer": buf,
+		"slice": NewSliceReader(data, WithVarintLength()),
+	} {
+		m, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("%s: ReadMessage: %v", name, err)
+		}
+		if v, err := m.ReadUint32(); err != nil || v != 7 {
+			t.Fatalf("%s: ReadUint32 in the message returned %d, %v", name, v, err)
+		}
+		if v, err := r.ReadByte(); err != nil || v != 0xee {
+			t.Fatalf("%s: the unread tail of the message is not discarded, got %x, %v", name, v, err)
+		}
+		m.SkipBytes()
+		if _, err := m.ReadUint16(); err != io.EOF {
+			t.Fatalf("%s: reading beyond the message should return io.EOF, got %v", name, err)
+		}
+	}
+
+	v2 := outerV2{Inner: nestedV2{"pio", []uint32{1, 2}}, Tail: 0xabcd}
+	out := NewBuffer(nil)
+	if err := Marshal(out, &v2); err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var v1 outerV1
+	if err := Unmarshal(out, &v1); err != nil || v1.Inner.Name != "pio" || v1.Tail != 0xabcd {
+		t.Fatalf("Unmarshal the newer struct returned %+v, %v", v1, err)
+	}
+	Marshal(out, &v1)
+	var u outerV2
+	if err := Unmarshal(out, &u); err != io.EOF {
+		t.Fatalf("Unmarshal the older struct should fail inside the message, got %v", err)
+	}
+}
+
+type badInner struct{
+	Self *badInner
+	Bad chan int
+}
+
+type badOuter struct{
+	In badInner
+}
+
+func TestMarshalBadTypeCache(t *testing.T){
+	if err := Marshal(NewBuffer(nil), &badOuter{}); err == nil {
+		t.Fatalf("Marshal of a chan field should fail")
+	}
+	// the codec of *badInner must not be cached with the failed placeholder of badInner
+	v := struct{
+		P *badInner
+	}{P: new(badInner)}
+	if err := Marshal(NewBuffer(nil), &v); err == nil {
+		t.Fatalf("Marshal of a chan field should fail")
+	}
+	if err := Unmarshal(NewBuffer([]byte{1, 0, 0}), &v); err == nil {
+		t.Fatalf("Unmarshal of a chan field should fail")
+	}
+}
+
+func TestMarshalHugeLength(t *testing.T){
+	var v struct{
+		S [][65536]uint64
+	}
+	if err := Unmarshal(NewBuffer([]byte{0xff, 0xff, 0xff, 0xff}), &v); err == nil {
+		t.Fatalf("Unmarshal a huge slice length with a short body should fail")
+	}
+	var m struct{
+		M map[uint64][1024]uint64
+	}
+	if err := Unmarshal(NewBuffer([]byte{0xff, 0xff, 0xff, 0xff, 1, 2}), &m); err == nil {
+		t.Fatalf("Unmarshal a huge map length with a short body should fail")
+	}
+}
@@ -0,0 +1,37 @@
+package encoding
+
+import (
+	"fmt"
+)
+
+// Limits bounds the sizes a Reader accepts, so a corrupted or malicious input cannot exhaust the memory.
+// A zero field means no limit
+type Limits struct{
+	// MaxFrameSize is the max size of a whole frame, it's enforced by pio.Conn
+	MaxFrameSize uint32
+	// MaxBytesLen is the max length of strings and byte slices
+	MaxBytesLen uint32
+	// MaxSliceLen is the max element count of slices and maps
+	MaxSliceLen uint32
+	// MaxTotalBytes is the max bytes can be read from a single Reader, e.g. a packet body
+	MaxTotalBytes int64
+}
+
+// LimitError is returned when an input exceeds the Limits
+type LimitError struct{
+	// Limit is the name of the exceeded field of Limits
+	Limit string
+	Max int64
+	Size int64
+}
+
+func (e *LimitError)Error()(string){
+	return fmt.Sprintf("encoding: %s exceeded: %d > %d", e.Limit, e.Size, e.Max)
+}
+
+// WithLimits makes the Reader enforce the limits
+func WithLimits(limits Limits)(Option){
+	return func(o *options){
+		o.limits = limits
+	}
+}
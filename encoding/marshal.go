@@ -0,0 +1,855 @@
+package encoding
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Marshaler is implemented by types that know how to write themselves,
+// it will be used by Marshal for nested values instead of reflection.
+type Marshaler interface{
+	WriteTo(Writer)(error)
+}
+
+// Unmarshaler is the decode counterpart of Marshaler.
+type Unmarshaler interface{
+	ParseFrom(Reader)(error)
+}
+
+var (
+	marshalerType = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+)
+
+type UnsupportedTypeError struct{
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError)Error()(string){
+	return "encoding: unsupported type " + e.Type.String()
+}
+
+type FixedSizeError struct{
+	Field string
+	Size int
+	Len int
+}
+
+func (e *FixedSizeError)Error()(string){
+	return fmt.Sprintf("encoding: field %s has fixed size %d, but got %d", e.Field, e.Size, e.Len)
+}
+
+// Marshal writes v into w by walking the exported fields of the struct in order.
+// Fields can be controlled with the `pio` struct tag:
+//   `pio:"-"`        skip the field
+//   `pio:"order=N"`  encode the field at position N instead of the declaration position
+//   `pio:"size=N"`   the string, slice or bytes has exactly N elements and no length prefix
+//   `pio:"varint"`   the integer is encoded as varint, signed integers use zigzag encoding
+//   `pio:"packed"`   the bool slice or array is packed with 8 bools per byte, see WritePackedBools
+//   `pio:"message"`  the field is wrapped in a message, so the parser ignores the unknown tail of it, see Writer.WriteMessage
+// Pointer fields are optional values, they are prefixed with a presence byte.
+// time.Time, big.Int, big.Float, net.IP, netip.Addr and netip.AddrPort use the canonical layouts of WriteTime etc.
+func Marshal(w Writer, v any)(err error){
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return errors.New("encoding: Marshal nil pointer")
+		}
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() {
+		return errors.New("encoding: Marshal nil value")
+	}
+	var c *codec
+	if c, err = typeCodec(rv.Type(), false); err != nil {
+		return
+	}
+	return c.enc(w, rv)
+}
+
+// Unmarshal reads into v, which must be a non-nil pointer, with the same layout as Marshal.
+func Unmarshal(r Reader, v any)(err error){
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return errors.New("encoding: Unmarshal requires a non-nil pointer")
+	}
+	rv = rv.Elem()
+	for rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		rv = rv.Elem()
+	}
+	var c *codec
+	if c, err = typeCodec(rv.Type(), false); err != nil {
+		return
+	}
+	return c.dec(r, rv)
+}
+
+type (
+	encodeFunc func(w Writer, v reflect.Value)(error)
+	decodeFunc func(r Reader, v reflect.Value)(error)
+
+	codec struct{
+		enc encodeFunc
+		dec decodeFunc
+	}
+
+	fieldInfo struct{
+		name string
+		index int
+		order int
+		codec *codec
+	}
+)
+
+var codecCache = struct{
+	sync.Mutex
+	m map[reflect.Type]*codec
+	nested map[reflect.Type]*codec
+	// pending and pendingNested hold the codecs built by the running typeCodec call,
+	// they are moved to the cache only if the whole build succeeded,
+	// so no cached codec refers to the placeholder of a type that failed
+	pending map[reflect.Type]*codec
+	pendingNested map[reflect.Type]*codec
+}{
+	m: make(map[reflect.Type]*codec),
+	nested: make(map[reflect.Type]*codec),
+}
+
+// typeCodec returns the cached codec of the type,
+// nested codecs will prefer Marshaler and Unmarshaler if they are implemented.
+func typeCodec(t reflect.Type, nested bool)(c *codec, err error){
+	codecCache.Lock()
+	defer codecCache.Unlock()
+	codecCache.pending = make(map[reflect.Type]*codec)
+	codecCache.pendingNested = make(map[reflect.Type]*codec)
+	defer func(){
+		codecCache.pending, codecCache.pendingNested = nil, nil
+	}()
+	if c, err = typeCodecLocked(t, nested); err != nil {
+		return
+	}
+	for t, c := range codecCache.pending {
+		codecCache.m[t] = c
+	}
+	for t, c := range codecCache.pendingNested {
+		codecCache.nested[t] = c
+	}
+	return
+}
+
+func typeCodecLocked(t reflect.Type, nested bool)(c *codec, err error){
+	cached, cache := codecCache.m, codecCache.pending
+	if nested {
+		cached, cache = codecCache.nested, codecCache.pendingNested
+	}
+	if c, ok := cached[t]; ok {
+		return c, nil
+	}
+	if c, ok := cache[t]; ok {
+		return c, nil
+	}
+	if nested && reflect.PointerTo(t).Implements(marshalerType) && reflect.PointerTo(t).Implements(unmarshalerType) {
+		c = &codec{
+			enc: func(w Writer, v reflect.Value)(error){
+				return addrOf(v).Interface().(Marshaler).WriteTo(w)
+			},
+			dec: func(r Reader, v reflect.Value)(error){
+				return v.Addr().Interface().(Unmarshaler).ParseFrom(r)
+			},
+		}
+		cache[t] = c
+		return
+	}
+	if c = stdCodec(t); c != nil {
+		cache[t] = c
+		return
+	}
+	// register the placeholder first, so recursive types can refer to themselves
+	c = new(codec)
+	cache[t] = c
+	var built *codec
+	if built, err = buildCodec(t); err != nil {
+		return nil, err
+	}
+	*c = *built
+	return
+}
+
+// addrOf returns the pointer to v, v is copied if it's not addressable
+func addrOf(v reflect.Value)(reflect.Value){
+	if v.CanAddr() {
+		return v.Addr()
+	}
+	p := reflect.New(v.Type())
+	p.Elem().Set(v)
+	return p
+}
+
+func buildCodec(t reflect.Type)(c *codec, err error){
+	switch t.Kind() {
+	case reflect.Bool:
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return w.WriteBool(v.Bool()) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var b bool
+				if b, err = r.ReadBool(); err == nil {
+					v.SetBool(b)
+				}
+				return
+			},
+		}, nil
+	case reflect.Uint8:
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return w.WriteByte((byte)(v.Uint())) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var n byte
+				if n, err = r.ReadByte(); err == nil {
+					v.SetUint((uint64)(n))
+				}
+				return
+			},
+		}, nil
+	case reflect.Int8:
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return w.WriteInt8((int8)(v.Int())) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var n int8
+				if n, err = r.ReadInt8(); err == nil {
+					v.SetInt((int64)(n))
+				}
+				return
+			},
+		}, nil
+	case reflect.Uint16:
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return w.WriteUint16((uint16)(v.Uint())) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var n uint16
+				if n, err = r.ReadUint16(); err == nil {
+					v.SetUint((uint64)(n))
+				}
+				return
+			},
+		}, nil
+	case reflect.Int16:
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return w.WriteInt16((int16)(v.Int())) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var n int16
+				if n, err = r.ReadInt16(); err == nil {
+					v.SetInt((int64)(n))
+				}
+				return
+			},
+		}, nil
+	case reflect.Uint32:
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return w.WriteUint32((uint32)(v.Uint())) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var n uint32
+				if n, err = r.ReadUint32(); err == nil {
+					v.SetUint((uint64)(n))
+				}
+				return
+			},
+		}, nil
+	case reflect.Int32:
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return w.WriteInt32((int32)(v.Int())) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var n int32
+				if n, err = r.ReadInt32(); err == nil {
+					v.SetInt((int64)(n))
+				}
+				return
+			},
+		}, nil
+	case reflect.Uint64, reflect.Uint, reflect.Uintptr:
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return w.WriteUint64(v.Uint()) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var n uint64
+				if n, err = r.ReadUint64(); err == nil {
+					v.SetUint(n)
+				}
+				return
+			},
+		}, nil
+	case reflect.Int64, reflect.Int:
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return w.WriteInt64(v.Int()) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var n int64
+				if n, err = r.ReadInt64(); err == nil {
+					v.SetInt(n)
+				}
+				return
+			},
+		}, nil
+	case reflect.Float32:
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return w.WriteFloat32((float32)(v.Float())) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var n float32
+				if n, err = r.ReadFloat32(); err == nil {
+					v.SetFloat((float64)(n))
+				}
+				return
+			},
+		}, nil
+	case reflect.Float64:
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return w.WriteFloat64(v.Float()) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var n float64
+				if n, err = r.ReadFloat64(); err == nil {
+					v.SetFloat(n)
+				}
+				return
+			},
+		}, nil
+	case reflect.String:
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return w.WriteString(v.String()) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var s string
+				if s, err = r.ReadString(); err == nil {
+					v.SetString(s)
+				}
+				return
+			},
+		}, nil
+	case reflect.Slice:
+		return buildSliceCodec(t)
+	case reflect.Array:
+		return buildArrayCodec(t)
+	case reflect.Map:
+		return buildMapCodec(t)
+	case reflect.Pointer:
+		return buildPointerCodec(t)
+	case reflect.Struct:
+		return buildStructCodec(t)
+	}
+	return nil, &UnsupportedTypeError{t}
+}
+
+func buildSliceCodec(t reflect.Type)(c *codec, err error){
+	if t.Elem().Kind() == reflect.Uint8 {
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return w.WriteBytes(v.Bytes()) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var buf []byte
+				if buf, err = r.ReadBytes(); err == nil {
+					v.SetBytes(buf)
+				}
+				return
+			},
+		}, nil
+	}
+	if c = packedSliceCodec(t); c != nil {
+		return
+	}
+	var elem *codec
+	if elem, err = typeCodecLocked(t.Elem(), true); err != nil {
+		return
+	}
+	return &codec{
+		enc: func(w Writer, v reflect.Value)(err error){
+			if err = w.WriteLength((uint32)(v.Len())); err != nil {
+				return
+			}
+			return encodeElems(w, v, elem)
+		},
+		dec: func(r Reader, v reflect.Value)(err error){
+			var l uint32
+			if l, err = r.ReadLength(); err != nil {
+				return
+			}
+			s := reflect.MakeSlice(t, 0, preallocLen(l, t.Elem().Size()))
+			zero := reflect.Zero(t.Elem())
+			for i := 0; i < (int)(l); i++ {
+				s = reflect.Append(s, zero)
+				if err = elem.dec(r, s.Index(i)); err != nil {
+					return
+				}
+			}
+			v.Set(s)
+			return
+		},
+	}, nil
+}
+
+// packedSliceCodec returns the codec which uses the slice helpers of Reader and Writer,
+// or nil if the slice type has no such helper.
+func packedSliceCodec(t reflect.Type)(*codec){
+	switch t {
+	case reflect.TypeOf(([]bool)(nil)):
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return w.WriteBools(v.Interface().([]bool)) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var s []bool
+				if s, err = r.ReadBools(); err == nil {
+					v.Set(reflect.ValueOf(s))
+				}
+				return
+			},
+		}
+	case reflect.TypeOf(([]uint16)(nil)):
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return w.WriteUint16s(v.Interface().([]uint16)) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var s []uint16
+				if s, err = r.ReadUint16s(); err == nil {
+					v.Set(reflect.ValueOf(s))
+				}
+				return
+			},
+		}
+	case reflect.TypeOf(([]uint32)(nil)):
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return w.WriteUint32s(v.Interface().([]uint32)) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var s []uint32
+				if s, err = r.ReadUint32s(); err == nil {
+					v.Set(reflect.ValueOf(s))
+				}
+				return
+			},
+		}
+	case reflect.TypeOf(([]uint64)(nil)):
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return w.WriteUint64s(v.Interface().([]uint64)) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var s []uint64
+				if s, err = r.ReadUint64s(); err == nil {
+					v.Set(reflect.ValueOf(s))
+				}
+				return
+			},
+		}
+	case reflect.TypeOf(([]int8)(nil)):
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return w.WriteInt8s(v.Interface().([]int8)) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var s []int8
+				if s, err = r.ReadInt8s(); err == nil {
+					v.Set(reflect.ValueOf(s))
+				}
+				return
+			},
+		}
+	case reflect.TypeOf(([]int16)(nil)):
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return w.WriteInt16s(v.Interface().([]int16)) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var s []int16
+				if s, err = r.ReadInt16s(); err == nil {
+					v.Set(reflect.ValueOf(s))
+				}
+				return
+			},
+		}
+	case reflect.TypeOf(([]int32)(nil)):
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return w.WriteInt32s(v.Interface().([]int32)) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var s []int32
+				if s, err = r.ReadInt32s(); err == nil {
+					v.Set(reflect.ValueOf(s))
+				}
+				return
+			},
+		}
+	case reflect.TypeOf(([]int64)(nil)):
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return w.WriteInt64s(v.Interface().([]int64)) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var s []int64
+				if s, err = r.ReadInt64s(); err == nil {
+					v.Set(reflect.ValueOf(s))
+				}
+				return
+			},
+		}
+	case reflect.TypeOf(([]float32)(nil)):
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return w.WriteFloat32s(v.Interface().([]float32)) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var s []float32
+				if s, err = r.ReadFloat32s(); err == nil {
+					v.Set(reflect.ValueOf(s))
+				}
+				return
+			},
+		}
+	case reflect.TypeOf(([]float64)(nil)):
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return w.WriteFloat64s(v.Interface().([]float64)) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var s []float64
+				if s, err = r.ReadFloat64s(); err == nil {
+					v.Set(reflect.ValueOf(s))
+				}
+				return
+			},
+		}
+	}
+	return nil
+}
+
+func buildArrayCodec(t reflect.Type)(c *codec, err error){
+	var elem *codec
+	if elem, err = typeCodecLocked(t.Elem(), true); err != nil {
+		return
+	}
+	return &codec{
+		enc: func(w Writer, v reflect.Value)(error){
+			return encodeElems(w, v, elem)
+		},
+		dec: func(r Reader, v reflect.Value)(error){
+			return decodeElems(r, v, elem)
+		},
+	}, nil
+}
+
+func encodeElems(w Writer, v reflect.Value, elem *codec)(err error){
+	for i, l := 0, v.Len(); i < l; i++ {
+		if err = elem.enc(w, v.Index(i)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func decodeElems(r Reader, v reflect.Value, elem *codec)(err error){
+	for i, l := 0, v.Len(); i < l; i++ {
+		if err = elem.dec(r, v.Index(i)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func buildMapCodec(t reflect.Type)(c *codec, err error){
+	var key, val *codec
+	if key, err = typeCodecLocked(t.Key(), true); err != nil {
+		return
+	}
+	if val, err = typeCodecLocked(t.Elem(), true); err != nil {
+		return
+	}
+	return &codec{
+		enc: func(w Writer, v reflect.Value)(err error){
+			if err = w.WriteLength((uint32)(v.Len())); err != nil {
+				return
+			}
+			iter := v.MapRange()
+			for iter.Next() {
+				if err = key.enc(w, iter.Key()); err != nil {
+					return
+				}
+				if err = val.enc(w, iter.Value()); err != nil {
+					return
+				}
+			}
+			return
+		},
+		dec: func(r Reader, v reflect.Value)(err error){
+			var l uint32
+			if l, err = r.ReadLength(); err != nil {
+				return
+			}
+			m := reflect.MakeMapWithSize(t, preallocLen(l, t.Key().Size() + t.Elem().Size()))
+			for i := (uint32)(0); i < l; i++ {
+				k, e := reflect.New(t.Key()).Elem(), reflect.New(t.Elem()).Elem()
+				if err = key.dec(r, k); err != nil {
+					return
+				}
+				if err = val.dec(r, e); err != nil {
+					return
+				}
+				m.SetMapIndex(k, e)
+			}
+			v.Set(m)
+			return
+		},
+	}, nil
+}
+
+func buildPointerCodec(t reflect.Type)(c *codec, err error){
+	var elem *codec
+	if elem, err = typeCodecLocked(t.Elem(), true); err != nil {
+		return
+	}
+	return &codec{
+		enc: func(w Writer, v reflect.Value)(err error){
+			if v.IsNil() {
+				return w.WriteBool(false)
+			}
+			if err = w.WriteBool(true); err != nil {
+				return
+			}
+			return elem.enc(w, v.Elem())
+		},
+		dec: func(r Reader, v reflect.Value)(err error){
+			var ok bool
+			if ok, err = r.ReadBool(); err != nil {
+				return
+			}
+			if !ok {
+				v.Set(reflect.Zero(t))
+				return
+			}
+			p := reflect.New(t.Elem())
+			if err = elem.dec(r, p.Elem()); err != nil {
+				return
+			}
+			v.Set(p)
+			return
+		},
+	}, nil
+}
+
+func buildStructCodec(t reflect.Type)(c *codec, err error){
+	fields := make([]fieldInfo, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		info := fieldInfo{
+			name: f.Name,
+			index: i,
+			order: i,
+		}
+		size := -1
+		varint, packed, message := false, false, false
+		tag := f.Tag.Get("pio")
+		if tag == "-" {
+			continue
+		}
+		if tag != "" {
+			for _, opt := range strings.Split(tag, ",") {
+				k, v, _ := strings.Cut(strings.TrimSpace(opt), "=")
+				switch k {
+				case "order":
+					if info.order, err = strconv.Atoi(v); err != nil {
+						return nil, fmt.Errorf("encoding: field %s.%s: bad order %q", t.Name(), f.Name, v)
+					}
+				case "varint":
+					varint = true
+				case "packed":
+					packed = true
+				case "message":
+					message = true
+				case "size":
+					if size, err = strconv.Atoi(v); err != nil || size < 0 {
+						return nil, fmt.Errorf("encoding: field %s.%s: bad size %q", t.Name(), f.Name, v)
+					}
+				default:
+					return nil, fmt.Errorf("encoding: field %s.%s: unknown tag option %q", t.Name(), f.Name, k)
+				}
+			}
+		}
+		if size >= 0 {
+			info.codec, err = buildFixedCodec(f.Type, t.Name() + "." + f.Name, size)
+		}else if varint {
+			info.codec, err = buildVarintCodec(f.Type, t.Name() + "." + f.Name)
+		}else if packed {
+			info.codec, err = buildPackedCodec(f.Type, t.Name() + "." + f.Name)
+		}else{
+			info.codec, err = typeCodecLocked(f.Type, true)
+		}
+		if err != nil {
+			return
+		}
+		if message {
+			info.codec = buildMessageCodec(info.codec)
+		}
+		fields = append(fields, info)
+	}
+	sort.SliceStable(fields, func(i, j int)(bool){ return fields[i].order < fields[j].order })
+	return &codec{
+		enc: func(w Writer, v reflect.Value)(err error){
+			for _, f := range fields {
+				if err = f.codec.enc(w, v.Field(f.index)); err != nil {
+					return
+				}
+			}
+			return
+		},
+		dec: func(r Reader, v reflect.Value)(err error){
+			for _, f := range fields {
+				if err = f.codec.dec(r, v.Field(f.index)); err != nil {
+					return
+				}
+			}
+			return
+		},
+	}, nil
+}
+
+// buildFixedCodec returns the codec of a string or slice without length prefix
+func buildFixedCodec(t reflect.Type, name string, size int)(c *codec, err error){
+	switch t.Kind() {
+	case reflect.String:
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(err error){
+				if v.Len() != size {
+					return &FixedSizeError{name, size, v.Len()}
+				}
+				_, err = w.Write(([]byte)(v.String()))
+				return
+			},
+			dec: func(r Reader, v reflect.Value)(err error){
+				buf := make([]byte, size)
+				if _, err = io.ReadFull(r, buf); err == nil {
+					v.SetString((string)(buf))
+				}
+				return
+			},
+		}, nil
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &codec{
+				enc: func(w Writer, v reflect.Value)(err error){
+					if v.Len() != size {
+						return &FixedSizeError{name, size, v.Len()}
+					}
+					_, err = w.Write(v.Bytes())
+					return
+				},
+				dec: func(r Reader, v reflect.Value)(err error){
+					buf := make([]byte, size)
+					if _, err = io.ReadFull(r, buf); err == nil {
+						v.SetBytes(buf)
+					}
+					return
+				},
+			}, nil
+		}
+		var elem *codec
+		if elem, err = typeCodecLocked(t.Elem(), true); err != nil {
+			return
+		}
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){
+				if v.Len() != size {
+					return &FixedSizeError{name, size, v.Len()}
+				}
+				return encodeElems(w, v, elem)
+			},
+			dec: func(r Reader, v reflect.Value)(error){
+				v.Set(reflect.MakeSlice(t, size, size))
+				return decodeElems(r, v, elem)
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("encoding: field %s: size option is not supported by %s", name, t)
+}
+
+func buildVarintCodec(t reflect.Type, name string)(c *codec, err error){
+	switch t.Kind() {
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint, reflect.Uintptr:
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return w.WriteVarUint(v.Uint()) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var n uint64
+				if n, err = r.ReadVarUint(); err != nil {
+					return
+				}
+				if v.OverflowUint(n) {
+					return fmt.Errorf("encoding: field %s: value %d overflows %s", name, n, t)
+				}
+				v.SetUint(n)
+				return
+			},
+		}, nil
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Int:
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return w.WriteVarInt(v.Int()) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var n int64
+				if n, err = r.ReadVarInt(); err != nil {
+					return
+				}
+				if v.OverflowInt(n) {
+					return fmt.Errorf("encoding: field %s: value %d overflows %s", name, n, t)
+				}
+				v.SetInt(n)
+				return
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("encoding: field %s: varint option is not supported by %s", name, t)
+}
+
+func buildPackedCodec(t reflect.Type, name string)(c *codec, err error){
+	if t.Kind() != reflect.Slice && t.Kind() != reflect.Array || t.Elem().Kind() != reflect.Bool {
+		return nil, fmt.Errorf("encoding: field %s: packed option is not supported by %s", name, t)
+	}
+	toBools := func(v reflect.Value)(bs []bool){
+		bs = make([]bool, v.Len())
+		for i := range bs {
+			bs[i] = v.Index(i).Bool()
+		}
+		return
+	}
+	if t.Kind() == reflect.Array {
+		// arrays have no length prefix
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(err error){
+				_, err = w.Write(packBools(toBools(v)))
+				return
+			},
+			dec: func(r Reader, v reflect.Value)(err error){
+				buf := make([]byte, (v.Len() + 7) / 8)
+				if _, err = io.ReadFull(r, buf); err != nil {
+					return
+				}
+				bs := make([]bool, v.Len())
+				unpackBools(buf, bs)
+				for i, ok := range bs {
+					v.Index(i).SetBool(ok)
+				}
+				return
+			},
+		}, nil
+	}
+	return &codec{
+		enc: func(w Writer, v reflect.Value)(error){ return WritePackedBools(w, toBools(v)) },
+		dec: func(r Reader, v reflect.Value)(err error){
+			var bs []bool
+			if bs, err = ReadPackedBools(r); err != nil {
+				return
+			}
+			s := reflect.MakeSlice(t, len(bs), len(bs))
+			for i, ok := range bs {
+				s.Index(i).SetBool(ok)
+			}
+			v.Set(s)
+			return
+		},
+	}, nil
+}
+
+// buildMessageCodec wraps the codec of a field in a message
+func buildMessageCodec(c *codec)(*codec){
+	return &codec{
+		enc: func(w Writer, v reflect.Value)(error){
+			return w.WriteMessage(func(w Writer)(error){ return c.enc(w, v) })
+		},
+		dec: func(r Reader, v reflect.Value)(error){
+			return ParseMessage(r, func(m Reader)(error){ return c.dec(m, v) })
+		},
+	}
+}
@@ -0,0 +1,51 @@
+package encoding
+
+import (
+	"bytes"
+	"math"
+)
+
+// A message is a length prefixed bytes value which holds nested values,
+// so a parser which does not know all the nested values can still skip the rest of the message.
+
+// WriteMessage writes the values written by fn as a message.
+// The values are buffered until fn returned, and nothing is written if fn returned an error
+func (w *writer)WriteMessage(fn func(Writer)(error))(err error){
+	buf := new(bytes.Buffer)
+	if err = fn(&writer{Writer: buf, opts: w.opts}); err != nil {
+		return
+	}
+	if buf.Len() > math.MaxUint32 {
+		return ErrLengthOverflow
+	}
+	return w.WriteBytes(buf.Bytes())
+}
+
+// ReadMessage reads a message, and returns a reader of the nested values with the same options.
+// The whole message is consumed from r, so the unread tail is discarded,
+// and reading beyond the end of the message returns io.EOF or io.ErrUnexpectedEOF
+func (r *reader)ReadMessage()(m Reader, err error){
+	var buf []byte
+	if buf, err = r.ReadBytes(); err != nil {
+		return
+	}
+	return newSliceReader(buf, r.opts), nil
+}
+
+// ParseMessage reads a message, and calls fn with the reader of the message
+func ParseMessage(r Reader, fn func(Reader)(error))(err error){
+	var m Reader
+	if m, err = r.ReadMessage(); err != nil {
+		return
+	}
+	return fn(m)
+}
+
+// ReadMessage returns a reader of the message which shares the memory of the buffer
+func (r *SliceReader)ReadMessage()(m Reader, err error){
+	var buf []byte
+	if buf, err = r.ReadBytesView(); err != nil {
+		return
+	}
+	return newSliceReader(buf, r.opts), nil
+}
@@ -0,0 +1,49 @@
+package encoding
+
+import (
+	"encoding/binary"
+)
+
+type options struct{
+	varLen bool
+	order binary.ByteOrder
+	limits Limits
+	unsafeStr bool
+}
+
+// Option configures the Reader and Writer created by WrapReader, WrapWriter and NewBuffer
+type Option func(*options)
+
+func newOptions(opts []Option)(o options){
+	o.order = binary.LittleEndian
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return
+}
+
+// WithVarintLength makes the length prefix of strings and slices encoded as unsigned varint instead of uint32.
+// Both sides must use the same option.
+func WithVarintLength()(Option){
+	return func(o *options){
+		o.varLen = true
+	}
+}
+
+// WithByteOrder sets the byte order of the fixed width integers and floats, the default is little endian
+func WithByteOrder(order binary.ByteOrder)(Option){
+	if order == nil {
+		panic("order cannot be nil")
+	}
+	return func(o *options){
+		o.order = order
+	}
+}
+
+// WithUnsafeString makes SliceReader.ReadString return strings which share the memory of the buffer,
+// so the buffer must not be modified after that
+func WithUnsafeString()(Option){
+	return func(o *options){
+		o.unsafeStr = true
+	}
+}
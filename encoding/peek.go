@@ -0,0 +1,95 @@
+package encoding
+
+import (
+	"io"
+)
+
+type peeker interface{
+	Peek(n int)(buf []byte, err error)
+}
+
+// peekSource keeps the peeked bytes of a reader which cannot peek by itself
+type peekSource struct{
+	io.Reader
+	buf []byte
+}
+
+func (s *peekSource)Read(buf []byte)(n int, err error){
+	if len(s.buf) > 0 {
+		n = copy(buf, s.buf)
+		s.buf = s.buf[n:]
+		return
+	}
+	return s.Reader.Read(buf)
+}
+
+func (s *peekSource)Peek(n int)(buf []byte, err error){
+	if l := len(s.buf); l < n {
+		s.buf = append(s.buf, make([]byte, n - l)...)
+		m, er := io.ReadFull(s.Reader, s.buf[l:])
+		s.buf = s.buf[:l + m]
+		if er != nil {
+			if er == io.EOF && l > 0 {
+				er = io.ErrUnexpectedEOF
+			}
+			return s.buf, er
+		}
+	}
+	return s.buf[:n:n], nil
+}
+
+func (s *peekSource)Close()(error){
+	if c, ok := s.Reader.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Peek returns the next n bytes without consuming them, the result is only valid until the next read.
+// If there are less than n bytes, the rest bytes are returned with io.EOF or io.ErrUnexpectedEOF.
+// The bytes are buffered by the reader if the underlying reader cannot peek,
+// so the underlying reader should not be read directly after Peek
+func (r *reader)Peek(n int)(buf []byte, err error){
+	if n < 0 {
+		panic("encoding: negative peek count")
+	}
+	if err = r.checkTotal((int64)(n)); err != nil {
+		return
+	}
+	p, ok := r.Reader.(peeker)
+	if !ok {
+		s := &peekSource{Reader: r.Reader}
+		r.Reader, p = s, s
+	}
+	return p.Peek(n)
+}
+
+// Skip discards the next n bytes, it returns io.ErrUnexpectedEOF if there are less than n bytes
+func (r *reader)Skip(n int64)(err error){
+	if n < 0 {
+		panic("encoding: negative skip count")
+	}
+	if err = r.checkTotal(n); err != nil {
+		return
+	}
+	m, err := io.CopyN(io.Discard, r.Reader, n)
+	r.n += m
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// SkipBytes discards a length prefixed value which element is one byte, such as a bytes, a string or a []bool.
+// The value is not allocated, so MaxBytesLen and MaxSliceLen are not checked
+func (r *reader)SkipBytes()(err error){
+	var l uint32
+	if l, err = r.readPrefix(); err != nil {
+		return
+	}
+	return r.Skip((int64)(l))
+}
+
+func (r *reader)BytesRead()(int64){
+	return r.n
+}
@@ -2,7 +2,14 @@
 package encoding
 
 import (
+	"errors"
 	"io"
+	"math"
+)
+
+var (
+	ErrVarintOverflow = errors.New("encoding: varint overflows a 64-bit integer")
+	ErrLengthOverflow = errors.New("encoding: length prefix overflows uint32")
 )
 
 type (
@@ -14,29 +21,160 @@ type (
 		ReadUint16()(v uint16, err error)
 		ReadUint32()(v uint32, err error)
 		ReadUint64()(v uint64, err error)
+		ReadInt8()(v int8, err error)
+		ReadInt16()(v int16, err error)
+		ReadInt32()(v int32, err error)
+		ReadInt64()(v int64, err error)
 		ReadFloat32()(v float32, err error)
 		ReadFloat64()(v float64, err error)
+		ReadVarUint()(v uint64, err error)
+		ReadVarInt()(v int64, err error)
+		ReadLength()(l uint32, err error)
 		ReadString()(v string, err error)
 		ReadBools()(v []bool, err error)
 		ReadBytes()(v []byte, err error)
+		ReadBytesTo(w io.Writer)(n int64, err error)
+		ReadBytesReader()(r *io.LimitedReader, err error)
 		ReadUint16s()(v []uint16, err error)
 		ReadUint32s()(v []uint32, err error)
 		ReadUint64s()(v []uint64, err error)
+		ReadInt8s()(v []int8, err error)
+		ReadInt16s()(v []int16, err error)
+		ReadInt32s()(v []int32, err error)
+		ReadInt64s()(v []int64, err error)
+		ReadFloat32s()(v []float32, err error)
+		ReadFloat64s()(v []float64, err error)
+		ReadMessage()(m Reader, err error)
+		// Peek returns the next n bytes without consuming them, see reader.Peek
+		Peek(n int)(buf []byte, err error)
+		Skip(n int64)(err error)
+		SkipBytes()(err error)
+		// BytesRead returns the count of bytes consumed from the reader
+		BytesRead()(int64)
 	}
 	reader struct{
 		io.Reader
+		opts options
+		n int64
+		scratch [8]byte
 	}
 )
 
 var _ Reader = (*reader)(nil)
 
-func WrapReader(old io.Reader)(Reader){
-	if r, ok := old.(Reader); ok {
+func WrapReader(old io.Reader, opts ...Option)(Reader){
+	if r, ok := old.(Reader); ok && len(opts) == 0 {
 		return r
 	}
 	return &reader{
 		Reader: old,
+		opts: newOptions(opts),
+	}
+}
+
+func (r *reader)Read(buf []byte)(n int, err error){
+	if max := r.opts.limits.MaxTotalBytes; max > 0 && r.n + (int64)(len(buf)) > max {
+		if r.n >= max && len(buf) > 0 {
+			return 0, &LimitError{"MaxTotalBytes", max, r.n + (int64)(len(buf))}
+		}
+		buf = buf[:max - r.n]
+	}
+	n, err = r.Reader.Read(buf)
+	r.n += (int64)(n)
+	return
+}
+
+func (r *reader)readFull(buf []byte)(err error){
+	if err = r.checkTotal((int64)(len(buf))); err != nil {
+		return
+	}
+	n, err := io.ReadFull(r.Reader, buf)
+	r.n += (int64)(n)
+	return
+}
+
+func (r *reader)checkTotal(n int64)(error){
+	if max := r.opts.limits.MaxTotalBytes; max > 0 && r.n + n > max {
+		return &LimitError{"MaxTotalBytes", max, r.n + n}
+	}
+	return nil
+}
+
+// readLen reads a length prefix and checks it with the limit
+func (r *reader)readLen(limit uint32, name string)(l uint32, err error){
+	if l, err = r.readPrefix(); err != nil {
+		return
+	}
+	if limit > 0 && l > limit {
+		return 0, &LimitError{name, (int64)(limit), (int64)(l)}
+	}
+	return
+}
+
+// readSlice reads the length prefixed body of a slice which element has the size
+func (r *reader)readSlice(size int64)(buf []byte, err error){
+	var l uint32
+	if l, err = r.ReadLength(); err != nil {
+		return
+	}
+	return r.readN((int64)(l) * size)
+}
+
+// readChunk is the max size readN allocates before the data actually arrived
+const readChunk = 64 * 1024
+
+func (r *reader)readN(n int64)(buf []byte, err error){
+	if err = r.checkTotal(n); err != nil {
+		return
 	}
+	if s, ok := r.Reader.(*sliceSource); ok && n > (int64)(len(s.buf) - s.off) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return readChunked(n, r.readFull)
+}
+
+// ReadN reads n bytes from r, the buffer grows while reading,
+// so a wrong length prefix cannot allocate the memory at once
+func ReadN(r io.Reader, n int64)(buf []byte, err error){
+	return readChunked(n, func(buf []byte)(err error){
+		_, err = io.ReadFull(r, buf)
+		return
+	})
+}
+
+// readChunked reads n bytes by readFull, and grows the buffer while reading,
+// so a wrong length prefix cannot allocate the memory at once
+func readChunked(n int64, readFull func(buf []byte)(error))(buf []byte, err error){
+	if n <= readChunk {
+		buf = make([]byte, n)
+		err = readFull(buf)
+		return
+	}
+	if (int64)((int)(n)) != n {
+		return nil, ErrLengthOverflow
+	}
+	buf = make([]byte, 0, readChunk)
+	for (int64)(len(buf)) < n {
+		l := len(buf)
+		m := (int)(n) - l
+		if m > l {
+			m = l
+		}
+		if m < readChunk {
+			m = readChunk
+		}
+		if m > (int)(n) - l {
+			m = (int)(n) - l
+		}
+		buf = append(buf, make([]byte, m)...)
+		if err = readFull(buf[l:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+	}
+	return
 }
 
 func (r *reader)Close()(error){
@@ -57,8 +195,8 @@ func (r *reader)ReadBool()(v bool, err error){
 }
 
 func (r *reader)ReadByte()(v byte, err error){
-	var buf [1]byte
-	_, err = io.ReadFull(r.Reader, buf[:])
+	buf := r.scratch[:1]
+	err = r.readFull(buf)
 	if err != nil {
 		return
 	}
@@ -67,52 +205,146 @@ func (r *reader)ReadByte()(v byte, err error){
 }
 
 func (r *reader)ReadUint16()(v uint16, err error){
-	var buf [2]byte
-	_, err = io.ReadFull(r.Reader, buf[:])
+	buf := r.scratch[:2]
+	err = r.readFull(buf)
 	if err != nil {
 		return
 	}
-	v = DecodeUint16(buf[:])
+	v = r.opts.order.Uint16(buf)
 	return
 }
 
 func (r *reader)ReadUint32()(v uint32, err error){
-	var buf [4]byte
-	_, err = io.ReadFull(r.Reader, buf[:])
+	buf := r.scratch[:4]
+	err = r.readFull(buf)
 	if err != nil {
 		return
 	}
-	v = DecodeUint32(buf[:])
+	v = r.opts.order.Uint32(buf)
 	return
 }
 
 func (r *reader)ReadUint64()(v uint64, err error){
-	var buf [8]byte
-	_, err = io.ReadFull(r.Reader, buf[:])
+	buf := r.scratch[:8]
+	err = r.readFull(buf)
+	if err != nil {
+		return
+	}
+	v = r.opts.order.Uint64(buf)
+	return
+}
+
+func (r *reader)ReadInt8()(v int8, err error){
+	var v0 byte
+	v0, err = r.ReadByte()
+	if err != nil {
+		return
+	}
+	v = (int8)(v0)
+	return
+}
+
+func (r *reader)ReadInt16()(v int16, err error){
+	buf := r.scratch[:2]
+	err = r.readFull(buf)
+	if err != nil {
+		return
+	}
+	v = (int16)(r.opts.order.Uint16(buf))
+	return
+}
+
+func (r *reader)ReadInt32()(v int32, err error){
+	buf := r.scratch[:4]
+	err = r.readFull(buf)
 	if err != nil {
 		return
 	}
-	v = DecodeUint64(buf[:])
+	v = (int32)(r.opts.order.Uint32(buf))
+	return
+}
+
+func (r *reader)ReadInt64()(v int64, err error){
+	buf := r.scratch[:8]
+	err = r.readFull(buf)
+	if err != nil {
+		return
+	}
+	v = (int64)(r.opts.order.Uint64(buf))
 	return
 }
 
 func (r *reader)ReadFloat32()(v float32, err error){
-	var buf [4]byte
-	_, err = io.ReadFull(r.Reader, buf[:])
+	buf := r.scratch[:4]
+	err = r.readFull(buf)
 	if err != nil {
 		return
 	}
-	v = DecodeFloat32(buf[:])
+	v = math.Float32frombits(r.opts.order.Uint32(buf))
 	return
 }
 
 func (r *reader)ReadFloat64()(v float64, err error){
-	var buf [8]byte
-	_, err = io.ReadFull(r.Reader, buf[:])
+	buf := r.scratch[:8]
+	err = r.readFull(buf)
 	if err != nil {
 		return
 	}
-	v = DecodeFloat64(buf[:])
+	v = math.Float64frombits(r.opts.order.Uint64(buf))
+	return
+}
+
+func (r *reader)ReadVarUint()(v uint64, err error){
+	var (
+		b byte
+		s uint
+	)
+	for i := 0; i < MaxVarintLen; i++ {
+		if b, err = r.ReadByte(); err != nil {
+			if i > 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+		if b < 0x80 {
+			if i == MaxVarintLen - 1 && b > 1 {
+				break
+			}
+			v |= (uint64)(b) << s
+			return
+		}
+		v |= (uint64)(b & 0x7f) << s
+		s += 7
+	}
+	return 0, ErrVarintOverflow
+}
+
+func (r *reader)ReadVarInt()(v int64, err error){
+	var u uint64
+	if u, err = r.ReadVarUint(); err != nil {
+		return
+	}
+	v = UnZigZag(u)
+	return
+}
+
+func (r *reader)ReadLength()(l uint32, err error){
+	return r.readLen(r.opts.limits.MaxSliceLen, "MaxSliceLen")
+}
+
+// readPrefix reads a length prefix without any limit
+func (r *reader)readPrefix()(l uint32, err error){
+	if !r.opts.varLen {
+		return r.ReadUint32()
+	}
+	var v uint64
+	if v, err = r.ReadVarUint(); err != nil {
+		return
+	}
+	if v > math.MaxUint32 {
+		return 0, ErrLengthOverflow
+	}
+	l = (uint32)(v)
 	return
 }
 
@@ -128,7 +360,7 @@ func (r *reader)ReadString()(v string, err error){
 
 func (r *reader)ReadBools()(v []bool, err error){
 	var v0 []byte
-	v0, err = r.ReadBytes()
+	v0, err = r.readSlice(1)
 	if err != nil {
 		return
 	}
@@ -141,87 +373,103 @@ func (r *reader)ReadBools()(v []bool, err error){
 
 func (r *reader)ReadBytes()(v []byte, err error){
 	var l uint32
-	l, err = r.ReadUint32()
+	l, err = r.readLen(r.opts.limits.MaxBytesLen, "MaxBytesLen")
 	if err != nil {
 		return
 	}
-	v = make([]byte, l)
-	_, err = io.ReadFull(r.Reader, v)
-	return
+	return r.readN((int64)(l))
 }
 
 func (r *reader)ReadUint16s()(v []uint16, err error){
-	var l uint32
-	l, err = r.ReadUint32()
-	if err != nil {
-		return
-	}
-	buf := make([]byte, l * 2)
-	_, err = io.ReadFull(r.Reader, buf)
+	var buf []byte
+	buf, err = r.readSlice(2)
 	if err != nil {
 		return
 	}
-	v = DecodeUint16s(buf)
+	v = decodeSlice(buf, 2, r.opts.order.Uint16)
 	return
 }
 
 func (r *reader)ReadUint32s()(v []uint32, err error){
-	var l uint32
-	l, err = r.ReadUint32()
+	var buf []byte
+	buf, err = r.readSlice(4)
 	if err != nil {
 		return
 	}
-	buf := make([]byte, l * 4)
-	_, err = io.ReadFull(r.Reader, buf)
+	v = decodeSlice(buf, 4, r.opts.order.Uint32)
+	return
+}
+
+func (r *reader)ReadUint64s()(v []uint64, err error){
+	var buf []byte
+	buf, err = r.readSlice(8)
 	if err != nil {
 		return
 	}
-	v = DecodeUint32s(buf)
+	v = decodeSlice(buf, 8, r.opts.order.Uint64)
 	return
 }
 
-func (r *reader)ReadUint64s()(v []uint64, err error){
-	var l uint32
-	l, err = r.ReadUint32()
+func (r *reader)ReadInt8s()(v []int8, err error){
+	var v0 []byte
+	v0, err = r.readSlice(1)
 	if err != nil {
 		return
 	}
-	buf := make([]byte, l * 8)
-	_, err = io.ReadFull(r.Reader, buf)
+	v = make([]int8, len(v0))
+	for i, o := range v0 {
+		v[i] = (int8)(o)
+	}
+	return
+}
+
+func (r *reader)ReadInt16s()(v []int16, err error){
+	var buf []byte
+	buf, err = r.readSlice(2)
 	if err != nil {
 		return
 	}
-	v = DecodeUint64s(buf)
+	v = decodeSlice(buf, 2, func(b []byte)(int16){ return (int16)(r.opts.order.Uint16(b)) })
 	return
 }
 
-func (r *reader)ReadFloat32s()(v []float32, err error){
-	var l uint32
-	l, err = r.ReadUint32()
+func (r *reader)ReadInt32s()(v []int32, err error){
+	var buf []byte
+	buf, err = r.readSlice(4)
 	if err != nil {
 		return
 	}
-	buf := make([]byte, l * 4)
-	_, err = io.ReadFull(r.Reader, buf)
+	v = decodeSlice(buf, 4, func(b []byte)(int32){ return (int32)(r.opts.order.Uint32(b)) })
+	return
+}
+
+func (r *reader)ReadInt64s()(v []int64, err error){
+	var buf []byte
+	buf, err = r.readSlice(8)
 	if err != nil {
 		return
 	}
-	v = DecodeFloat32s(buf)
+	v = decodeSlice(buf, 8, func(b []byte)(int64){ return (int64)(r.opts.order.Uint64(b)) })
 	return
 }
 
-func (r *reader)ReadFloat64s()(v []float64, err error){
-	var l uint32
-	l, err = r.ReadUint32()
+func (r *reader)ReadFloat32s()(v []float32, err error){
+	var buf []byte
+	buf, err = r.readSlice(4)
 	if err != nil {
 		return
 	}
-	buf := make([]byte, l * 8)
-	_, err = io.ReadFull(r.Reader, buf)
+	v = decodeSlice(buf, 4, func(b []byte)(float32){ return math.Float32frombits(r.opts.order.Uint32(b)) })
+	return
+}
+
+func (r *reader)ReadFloat64s()(v []float64, err error){
+	var buf []byte
+	buf, err = r.readSlice(8)
 	if err != nil {
 		return
 	}
-	v = DecodeFloat64s(buf)
+	v = decodeSlice(buf, 8, func(b []byte)(float64){ return math.Float64frombits(r.opts.order.Uint64(b)) })
 	return
 }
 
@@ -0,0 +1,157 @@
+package encoding
+
+import (
+	"io"
+	"unsafe"
+)
+
+// SliceReader decodes directly from a byte slice,
+// the fixed width values are decoded without allocation,
+// and ReadBytesView returns the sub-slice of the underlying buffer without copying.
+type SliceReader struct{
+	reader
+	src *sliceSource
+}
+
+var _ Reader = (*SliceReader)(nil)
+
+type sliceSource struct{
+	buf []byte
+	off int
+}
+
+func (s *sliceSource)Peek(n int)(buf []byte, err error){
+	buf = s.buf[s.off:]
+	if len(buf) < n {
+		if len(buf) == 0 {
+			return buf, io.EOF
+		}
+		return buf, io.ErrUnexpectedEOF
+	}
+	return buf[:n:n], nil
+}
+
+func (s *sliceSource)Read(buf []byte)(n int, err error){
+	if s.off >= len(s.buf) {
+		if len(buf) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	n = copy(buf, s.buf[s.off:])
+	s.off += n
+	return
+}
+
+func NewSliceReader(buf []byte, opts ...Option)(r *SliceReader){
+	return newSliceReader(buf, newOptions(opts))
+}
+
+func newSliceReader(buf []byte, opts options)(r *SliceReader){
+	r = &SliceReader{
+		src: &sliceSource{buf: buf},
+	}
+	r.reader = reader{
+		Reader: r.src,
+		opts: opts,
+	}
+	return
+}
+
+// Reset makes the reader decode from buf again, the options are kept
+func (r *SliceReader)Reset(buf []byte){
+	r.src.buf, r.src.off = buf, 0
+	r.reader.n = 0
+}
+
+// Bytes returns the unread part of the buffer
+func (r *SliceReader)Bytes()([]byte){
+	return r.src.buf[r.src.off:]
+}
+
+func (r *SliceReader)Offset()(int){
+	return r.src.off
+}
+
+func (r *SliceReader)Remaining()(int){
+	return len(r.src.buf) - r.src.off
+}
+
+// Skip discards the next n bytes without copying
+func (r *SliceReader)Skip(n int64)(err error){
+	if n < 0 {
+		panic("encoding: negative skip count")
+	}
+	_, err = r.view(n)
+	return
+}
+
+func (r *SliceReader)SkipBytes()(err error){
+	var l uint32
+	if l, err = r.readPrefix(); err != nil {
+		return
+	}
+	return r.Skip((int64)(l))
+}
+
+// view returns the next n bytes without copying
+func (r *SliceReader)view(n int64)(buf []byte, err error){
+	if err = r.checkTotal(n); err != nil {
+		return
+	}
+	if n > (int64)(r.Remaining()) {
+		r.reader.n += (int64)(r.Remaining())
+		r.src.off = len(r.src.buf)
+		return nil, io.ErrUnexpectedEOF
+	}
+	buf = r.src.buf[r.src.off:r.src.off + (int)(n):r.src.off + (int)(n)]
+	r.src.off += (int)(n)
+	r.reader.n += n
+	return
+}
+
+// ReadBytesView reads a length prefixed byte slice, which is a sub-slice of the underlying buffer.
+// The result is only valid as long as the buffer is not modified
+func (r *SliceReader)ReadBytesView()(v []byte, err error){
+	var l uint32
+	if l, err = r.readLen(r.opts.limits.MaxBytesLen, "MaxBytesLen"); err != nil {
+		return
+	}
+	return r.view((int64)(l))
+}
+
+func (r *SliceReader)ReadBytes()(v []byte, err error){
+	var v0 []byte
+	if v0, err = r.ReadBytesView(); err != nil {
+		return
+	}
+	v = make([]byte, len(v0))
+	copy(v, v0)
+	return
+}
+
+// ReadString copies the string out of the buffer,
+// or shares the memory of the buffer if WithUnsafeString is used
+func (r *SliceReader)ReadString()(v string, err error){
+	var v0 []byte
+	if v0, err = r.ReadBytesView(); err != nil {
+		return
+	}
+	if r.opts.unsafeStr {
+		if len(v0) == 0 {
+			return "", nil
+		}
+		return *(*string)(unsafe.Pointer(&v0)), nil
+	}
+	v = (string)(v0)
+	return
+}
+
+// ReadBytesView returns a sub-slice of the underlying buffer if r is a *SliceReader,
+// otherwise it's the same as r.ReadBytes
+func ReadBytesView(r Reader)([]byte, error){
+	if sr, ok := r.(*SliceReader); ok {
+		return sr.ReadBytesView()
+	}
+	return r.ReadBytes()
+}
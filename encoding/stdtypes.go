@@ -0,0 +1,289 @@
+package encoding
+
+import (
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/netip"
+	"reflect"
+	"time"
+)
+
+// The canonical layouts of the standard library types.
+// The integers use the byte order of the Writer, and the lengths use its length prefix.
+//
+//   time.Time       int64 unix seconds, uint32 nanoseconds in [0, 1e9); the location is not kept, decoded as UTC
+//   time.Duration   int64 nanoseconds
+//   *big.Int        byte sign (0 for non-negative, 1 for negative), bytes of the big-endian absolute value
+//   *big.Float      uint32 precision, byte rounding mode, string of the shortest decimal form (or "+Inf", "-Inf")
+//   net.IP          bytes of the 4 or 16 bytes address, or empty for a nil IP
+//   netip.Addr      bytes of netip.Addr.MarshalBinary: empty, 4 bytes, or 16 bytes followed by the zone
+//   netip.AddrPort  netip.Addr, uint16 port
+//   UUID            16 raw bytes without length prefix
+
+var ErrBadValue = errors.New("encoding: bad encoded value")
+
+type UUID [16]byte
+
+func WriteTime(w Writer, t time.Time)(err error){
+	if err = w.WriteInt64(t.Unix()); err != nil {
+		return
+	}
+	return w.WriteUint32((uint32)(t.Nanosecond()))
+}
+
+func ReadTime(r Reader)(t time.Time, err error){
+	var (
+		sec int64
+		nsec uint32
+	)
+	if sec, err = r.ReadInt64(); err != nil {
+		return
+	}
+	if nsec, err = r.ReadUint32(); err != nil {
+		return
+	}
+	if nsec >= 1e9 {
+		return time.Time{}, ErrBadValue
+	}
+	t = time.Unix(sec, (int64)(nsec)).UTC()
+	return
+}
+
+func WriteDuration(w Writer, d time.Duration)(error){
+	return w.WriteInt64((int64)(d))
+}
+
+func ReadDuration(r Reader)(d time.Duration, err error){
+	var v int64
+	if v, err = r.ReadInt64(); err != nil {
+		return
+	}
+	d = (time.Duration)(v)
+	return
+}
+
+// WriteBigInt writes v, a nil v is written as zero
+func WriteBigInt(w Writer, v *big.Int)(err error){
+	if v == nil {
+		v = new(big.Int)
+	}
+	var sign byte
+	if v.Sign() < 0 {
+		sign = 1
+	}
+	if err = w.WriteByte(sign); err != nil {
+		return
+	}
+	return w.WriteBytes(v.Bytes())
+}
+
+func ReadBigInt(r Reader)(v *big.Int, err error){
+	var (
+		sign byte
+		abs []byte
+	)
+	if sign, err = r.ReadByte(); err != nil {
+		return
+	}
+	if sign > 1 {
+		return nil, ErrBadValue
+	}
+	if abs, err = r.ReadBytes(); err != nil {
+		return
+	}
+	v = new(big.Int).SetBytes(abs)
+	if sign == 1 {
+		v.Neg(v)
+	}
+	return
+}
+
+// WriteBigFloat writes v, a nil v is written as zero
+func WriteBigFloat(w Writer, v *big.Float)(err error){
+	if v == nil {
+		v = new(big.Float)
+	}
+	if err = w.WriteUint32((uint32)(v.Prec())); err != nil {
+		return
+	}
+	if err = w.WriteByte((byte)(v.Mode())); err != nil {
+		return
+	}
+	return w.WriteString(v.Text('g', -1))
+}
+
+func ReadBigFloat(r Reader)(v *big.Float, err error){
+	var (
+		prec uint32
+		mode byte
+		text string
+	)
+	if prec, err = r.ReadUint32(); err != nil {
+		return
+	}
+	if mode, err = r.ReadByte(); err != nil {
+		return
+	}
+	if text, err = r.ReadString(); err != nil {
+		return
+	}
+	if prec > big.MaxPrec || mode > (byte)(big.ToPositiveInf) {
+		return nil, ErrBadValue
+	}
+	v = new(big.Float).SetPrec((uint)(prec))
+	if _, _, err = v.Parse(text, 10); err != nil {
+		return nil, ErrBadValue
+	}
+	if prec == 0 {
+		v.SetPrec(0)
+	}
+	v.SetMode((big.RoundingMode)(mode))
+	return
+}
+
+func WriteIP(w Writer, ip net.IP)(error){
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return w.WriteBytes(ip)
+}
+
+func ReadIP(r Reader)(ip net.IP, err error){
+	var buf []byte
+	if buf, err = r.ReadBytes(); err != nil {
+		return
+	}
+	switch len(buf) {
+	case 0:
+		return nil, nil
+	case net.IPv4len, net.IPv6len:
+		return (net.IP)(buf), nil
+	}
+	return nil, ErrBadValue
+}
+
+func WriteAddr(w Writer, addr netip.Addr)(err error){
+	var buf []byte
+	if buf, err = addr.MarshalBinary(); err != nil {
+		return
+	}
+	return w.WriteBytes(buf)
+}
+
+func ReadAddr(r Reader)(addr netip.Addr, err error){
+	var buf []byte
+	if buf, err = r.ReadBytes(); err != nil {
+		return
+	}
+	if err = addr.UnmarshalBinary(buf); err != nil {
+		return netip.Addr{}, ErrBadValue
+	}
+	return
+}
+
+func WriteAddrPort(w Writer, addr netip.AddrPort)(err error){
+	if err = WriteAddr(w, addr.Addr()); err != nil {
+		return
+	}
+	return w.WriteUint16(addr.Port())
+}
+
+func ReadAddrPort(r Reader)(addr netip.AddrPort, err error){
+	var (
+		ip netip.Addr
+		port uint16
+	)
+	if ip, err = ReadAddr(r); err != nil {
+		return
+	}
+	if port, err = r.ReadUint16(); err != nil {
+		return
+	}
+	addr = netip.AddrPortFrom(ip, port)
+	return
+}
+
+func WriteUUID(w Writer, id UUID)(err error){
+	_, err = w.Write(id[:])
+	return
+}
+
+func ReadUUID(r Reader)(id UUID, err error){
+	_, err = io.ReadFull(r, id[:])
+	return
+}
+
+// stdCodec returns the codec of the standard library types for Marshal, or nil if t is not one of them
+func stdCodec(t reflect.Type)(*codec){
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return WriteTime(w, v.Interface().(time.Time)) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var t time.Time
+				if t, err = ReadTime(r); err == nil {
+					v.Set(reflect.ValueOf(t))
+				}
+				return
+			},
+		}
+	case reflect.TypeOf(big.Int{}):
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return WriteBigInt(w, addrOf(v).Interface().(*big.Int)) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var n *big.Int
+				if n, err = ReadBigInt(r); err == nil {
+					v.Set(reflect.ValueOf(n).Elem())
+				}
+				return
+			},
+		}
+	case reflect.TypeOf(big.Float{}):
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return WriteBigFloat(w, addrOf(v).Interface().(*big.Float)) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var n *big.Float
+				if n, err = ReadBigFloat(r); err == nil {
+					v.Set(reflect.ValueOf(n).Elem())
+				}
+				return
+			},
+		}
+	case reflect.TypeOf(net.IP{}):
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return WriteIP(w, v.Interface().(net.IP)) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var ip net.IP
+				if ip, err = ReadIP(r); err == nil {
+					v.Set(reflect.ValueOf(ip))
+				}
+				return
+			},
+		}
+	case reflect.TypeOf(netip.Addr{}):
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return WriteAddr(w, v.Interface().(netip.Addr)) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var addr netip.Addr
+				if addr, err = ReadAddr(r); err == nil {
+					v.Set(reflect.ValueOf(addr))
+				}
+				return
+			},
+		}
+	case reflect.TypeOf(netip.AddrPort{}):
+		return &codec{
+			enc: func(w Writer, v reflect.Value)(error){ return WriteAddrPort(w, v.Interface().(netip.AddrPort)) },
+			dec: func(r Reader, v reflect.Value)(err error){
+				var addr netip.AddrPort
+				if addr, err = ReadAddrPort(r); err == nil {
+					v.Set(reflect.ValueOf(addr))
+				}
+				return
+			},
+		}
+	}
+	return nil
+}
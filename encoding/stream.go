@@ -0,0 +1,49 @@
+package encoding
+
+import (
+	"io"
+	"math"
+)
+
+// WriteBytesFrom writes n bytes read from r as a bytes value, without buffering them in memory.
+// It returns io.ErrUnexpectedEOF if r has less than n bytes, the written value is broken in that case
+func (w *writer)WriteBytesFrom(r io.Reader, n int64)(err error){
+	if n < 0 || n > math.MaxUint32 {
+		return ErrLengthOverflow
+	}
+	if err = w.WriteLength((uint32)(n)); err != nil {
+		return
+	}
+	var m int64
+	m, err = io.CopyN(w.Writer, r, n)
+	w.n += m
+	if err == io.EOF && m < n {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// ReadBytesTo reads a bytes value and copies it into w, without buffering it in memory
+func (r *reader)ReadBytesTo(w io.Writer)(n int64, err error){
+	var lr *io.LimitedReader
+	if lr, err = r.ReadBytesReader(); err != nil {
+		return
+	}
+	if n, err = io.Copy(w, lr); err == nil && lr.N > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// ReadBytesReader reads the length of a bytes value, and returns a reader of its content.
+// The content must be read to the end before reading the next value
+func (r *reader)ReadBytesReader()(lr *io.LimitedReader, err error){
+	var l uint32
+	if l, err = r.readLen(r.opts.limits.MaxBytesLen, "MaxBytesLen"); err != nil {
+		return
+	}
+	if err = r.checkTotal((int64)(l)); err != nil {
+		return
+	}
+	return &io.LimitedReader{R: r, N: (int64)(l)}, nil
+}
@@ -3,6 +3,7 @@ package encoding
 
 import (
 	"io"
+	"math"
 )
 
 type (
@@ -14,36 +15,54 @@ type (
 		WriteUint16(v uint16)(error)
 		WriteUint32(v uint32)(error)
 		WriteUint64(v uint64)(error)
+		WriteInt8(v int8)(error)
+		WriteInt16(v int16)(error)
+		WriteInt32(v int32)(error)
+		WriteInt64(v int64)(error)
 		WriteFloat32(v float32)(error)
 		WriteFloat64(v float64)(error)
+		WriteVarUint(v uint64)(error)
+		WriteVarInt(v int64)(error)
+		WriteLength(l uint32)(error)
 		WriteString(v string)(error)
 		WriteBools(v []bool)(error)
 		WriteBytes(v []byte)(error)
+		WriteBytesFrom(r io.Reader, n int64)(error)
 		WriteUint16s(v []uint16)(error)
 		WriteUint32s(v []uint32)(error)
 		WriteUint64s(v []uint64)(error)
+		WriteInt8s(v []int8)(error)
+		WriteInt16s(v []int16)(error)
+		WriteInt32s(v []int32)(error)
+		WriteInt64s(v []int64)(error)
 		WriteFloat32s(v []float32)(error)
 		WriteFloat64s(v []float64)(error)
+		WriteMessage(fn func(Writer)(error))(error)
+		// BytesWritten returns the count of bytes written to the writer
+		BytesWritten()(int64)
 	}
 	writer struct{
 		io.Writer
+		opts options
+		n int64
 	}
 )
 
 var _ Writer = (*writer)(nil)
 
-func WrapWriter(old io.Writer)(Writer){
-	if w, ok := old.(Writer); ok {
+func WrapWriter(old io.Writer, opts ...Option)(Writer){
+	if w, ok := old.(Writer); ok && len(opts) == 0 {
 		return w
 	}
 	return &writer{
 		Writer: old,
+		opts: newOptions(opts),
 	}
 }
 
-func Pipe()(r Reader, w Writer){
+func Pipe(opts ...Option)(r Reader, w Writer){
 	ir, iw := io.Pipe()
-	r, w = WrapReader(ir), WrapWriter(iw)
+	r, w = WrapReader(ir, opts...), WrapWriter(iw, opts...)
 	return
 }
 
@@ -54,6 +73,16 @@ func (w *writer)Close()(error){
 	return nil
 }
 
+func (w *writer)Write(buf []byte)(n int, err error){
+	n, err = w.Writer.Write(buf)
+	w.n += (int64)(n)
+	return
+}
+
+func (w *writer)BytesWritten()(int64){
+	return w.n
+}
+
 func (w *writer)WriteBool(v bool)(error){
 	if v {
 		return w.WriteByte(1)
@@ -63,7 +92,10 @@ func (w *writer)WriteBool(v bool)(error){
 
 func (w *writer)WriteByte(v byte)(err error){
 	if bw, ok := w.Writer.(io.ByteWriter); ok {
-		return bw.WriteByte(v)
+		if err = bw.WriteByte(v); err == nil {
+			w.n++
+		}
+		return
 	}
 	_, err = w.Write([]byte{v})
 	return
@@ -71,34 +103,83 @@ func (w *writer)WriteByte(v byte)(err error){
 
 func (w *writer)WriteUint16(v uint16)(err error){
 	var buf [2]byte
-	_, err = w.Write(EncodeUint16(buf[:], v))
+	w.opts.order.PutUint16(buf[:], v)
+	_, err = w.Write(buf[:])
 	return
 }
 
 func (w *writer)WriteUint32(v uint32)(err error){
 	var buf [4]byte
-	_, err = w.Write(EncodeUint32(buf[:], v))
+	w.opts.order.PutUint32(buf[:], v)
+	_, err = w.Write(buf[:])
 	return
 }
 
 func (w *writer)WriteUint64(v uint64)(err error){
 	var buf [8]byte
-	_, err = w.Write(EncodeUint64(buf[:], v))
+	w.opts.order.PutUint64(buf[:], v)
+	_, err = w.Write(buf[:])
+	return
+}
+
+func (w *writer)WriteInt8(v int8)(error){
+	return w.WriteByte((byte)(v))
+}
+
+func (w *writer)WriteInt16(v int16)(err error){
+	var buf [2]byte
+	w.opts.order.PutUint16(buf[:], (uint16)(v))
+	_, err = w.Write(buf[:])
+	return
+}
+
+func (w *writer)WriteInt32(v int32)(err error){
+	var buf [4]byte
+	w.opts.order.PutUint32(buf[:], (uint32)(v))
+	_, err = w.Write(buf[:])
+	return
+}
+
+func (w *writer)WriteInt64(v int64)(err error){
+	var buf [8]byte
+	w.opts.order.PutUint64(buf[:], (uint64)(v))
+	_, err = w.Write(buf[:])
 	return
 }
 
 func (w *writer)WriteFloat32(v float32)(err error){
 	var buf [4]byte
-	_, err = w.Write(EncodeFloat32(buf[:], v))
+	w.opts.order.PutUint32(buf[:], math.Float32bits(v))
+	_, err = w.Write(buf[:])
 	return
 }
 
 func (w *writer)WriteFloat64(v float64)(err error){
 	var buf [8]byte
-	_, err = w.Write(EncodeFloat64(buf[:], v))
+	w.opts.order.PutUint64(buf[:], math.Float64bits(v))
+	_, err = w.Write(buf[:])
+	return
+}
+
+func (w *writer)WriteVarUint(v uint64)(err error){
+	var buf [MaxVarintLen]byte
+	_, err = w.Write(EncodeVarUint(buf[:], v))
+	return
+}
+
+func (w *writer)WriteVarInt(v int64)(err error){
+	var buf [MaxVarintLen]byte
+	_, err = w.Write(EncodeVarInt(buf[:], v))
 	return
 }
 
+func (w *writer)WriteLength(l uint32)(error){
+	if w.opts.varLen {
+		return w.WriteVarUint((uint64)(l))
+	}
+	return w.WriteUint32(l)
+}
+
 func (w *writer)WriteString(v string)(err error){
 	return w.WriteBytes(([]byte)(v))
 }
@@ -114,7 +195,7 @@ func (w *writer)WriteBools(v []bool)(error){
 }
 
 func (w *writer)WriteBytes(v []byte)(err error){
-	if err = w.WriteUint32((uint32)(len(v))); err != nil {
+	if err = w.WriteLength((uint32)(len(v))); err != nil {
 		return
 	}
 	_, err = w.Write(v)
@@ -122,47 +203,82 @@ func (w *writer)WriteBytes(v []byte)(err error){
 }
 
 func (w *writer)WriteUint16s(v []uint16)(err error){
-	if err = w.WriteUint32((uint32)(len(v))); err != nil {
+	if err = w.WriteLength((uint32)(len(v))); err != nil {
 		return
 	}
 	buf := make([]byte, len(v) * 2)
-	_, err = w.Write(EncodeUint16s(buf, v))
+	_, err = w.Write(encodeSlice(buf, v, 2, w.opts.order.PutUint16))
 	return
 }
 
 func (w *writer)WriteUint32s(v []uint32)(err error){
-	if err = w.WriteUint32((uint32)(len(v))); err != nil {
+	if err = w.WriteLength((uint32)(len(v))); err != nil {
 		return
 	}
 	buf := make([]byte, len(v) * 4)
-	_, err = w.Write(EncodeUint32s(buf, v))
+	_, err = w.Write(encodeSlice(buf, v, 4, w.opts.order.PutUint32))
 	return
 }
 
 func (w *writer)WriteUint64s(v []uint64)(err error){
-	if err = w.WriteUint32((uint32)(len(v))); err != nil {
+	if err = w.WriteLength((uint32)(len(v))); err != nil {
+		return
+	}
+	buf := make([]byte, len(v) * 8)
+	_, err = w.Write(encodeSlice(buf, v, 8, w.opts.order.PutUint64))
+	return
+}
+
+func (w *writer)WriteInt8s(v []int8)(error){
+	buf := make([]byte, len(v))
+	for i, n := range v {
+		buf[i] = (byte)(n)
+	}
+	return w.WriteBytes(buf)
+}
+
+func (w *writer)WriteInt16s(v []int16)(err error){
+	if err = w.WriteLength((uint32)(len(v))); err != nil {
+		return
+	}
+	buf := make([]byte, len(v) * 2)
+	_, err = w.Write(encodeSlice(buf, v, 2, func(b []byte, n int16){ w.opts.order.PutUint16(b, (uint16)(n)) }))
+	return
+}
+
+func (w *writer)WriteInt32s(v []int32)(err error){
+	if err = w.WriteLength((uint32)(len(v))); err != nil {
+		return
+	}
+	buf := make([]byte, len(v) * 4)
+	_, err = w.Write(encodeSlice(buf, v, 4, func(b []byte, n int32){ w.opts.order.PutUint32(b, (uint32)(n)) }))
+	return
+}
+
+func (w *writer)WriteInt64s(v []int64)(err error){
+	if err = w.WriteLength((uint32)(len(v))); err != nil {
 		return
 	}
 	buf := make([]byte, len(v) * 8)
-	_, err = w.Write(EncodeUint64s(buf, v))
+	_, err = w.Write(encodeSlice(buf, v, 8, func(b []byte, n int64){ w.opts.order.PutUint64(b, (uint64)(n)) }))
 	return
 }
 
 func (w *writer)WriteFloat32s(v []float32)(err error){
-	if err = w.WriteUint32((uint32)(len(v))); err != nil {
+	if err = w.WriteLength((uint32)(len(v))); err != nil {
 		return
 	}
 	buf := make([]byte, len(v) * 4)
-	_, err = w.Write(EncodeFloat32s(buf, v))
+	_, err = w.Write(encodeSlice(buf, v, 4, func(b []byte, n float32){ w.opts.order.PutUint32(b, math.Float32bits(n)) }))
 	return
 }
 
 func (w *writer)WriteFloat64s(v []float64)(err error){
-	if err = w.WriteUint32((uint32)(len(v))); err != nil {
+	if err = w.WriteLength((uint32)(len(v))); err != nil {
 		return
 	}
 	buf := make([]byte, len(v) * 8)
-	_, err = w.Write(EncodeFloat64s(buf, v))
+	_, err = w.Write(encodeSlice(buf, v, 8, func(b []byte, n float64){ w.opts.order.PutUint64(b, math.Float64bits(n)) }))
 	return
 }
 
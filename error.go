@@ -0,0 +1,177 @@
+package pio
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/kmcsr/go-pio/encoding"
+)
+
+// The error packet (0x03) is the reply of an ask which failed, its payload is:
+//
+//   uint32  error code
+//   string  message, it's generic for ErrCodeInternal and ErrCodePanic
+//   bytes   details, its format is defined by the error code
+//
+// The codes below 0x100 are reserved by pio.
+
+const (
+	// ErrCodeInternal is the code of the errors returned by a handler which are not registered,
+	// their messages are not sent to the peer, see Conn.OnHandlerError
+	ErrCodeInternal uint32 = 0x01
+	ErrCodeUnknownPacket uint32 = 0x02
+	ErrCodeParse uint32 = 0x03
+	ErrCodePanic uint32 = 0x04
+	ErrCodeTooManyStreams uint32 = 0x05
+)
+
+var (
+	ErrInternal = errors.New("pio: internal error")
+	ErrUnknownPacket = errors.New("pio: unknown packet")
+	ErrParsePacket = errors.New("pio: cannot parse packet")
+	ErrHandlerPanic = errors.New("pio: handler panicked")
+	// ErrTooManyStreams is returned by SendStream when the peer rejected the stream, since it has too many open streams
+	ErrTooManyStreams = errors.New("pio: too many open streams")
+	// ErrStreamed is returned by the asks which are pending or sent while the Conn switches to a stream,
+	// their responses cannot be received any more
+	ErrStreamed = errors.New("pio: the conn switched to a stream")
+	// ErrStreamDrain is returned by Serve when the dispatched handlers do not return in time before the stream switch
+	ErrStreamDrain = errors.New("pio: the handlers did not return before the stream switch")
+)
+
+var errorCodes = struct{
+	sync.RWMutex
+	m map[uint32]error
+	// order is the codes in the registration order, codeOf checks them in this order
+	order []uint32
+}{
+	m: map[uint32]error{
+		ErrCodeInternal: ErrInternal,
+		ErrCodeUnknownPacket: ErrUnknownPacket,
+		ErrCodeParse: ErrParsePacket,
+		ErrCodePanic: ErrHandlerPanic,
+		ErrCodeTooManyStreams: ErrTooManyStreams,
+	},
+	order: []uint32{
+		ErrCodeInternal,
+		ErrCodeUnknownPacket,
+		ErrCodeParse,
+		ErrCodePanic,
+		ErrCodeTooManyStreams,
+	},
+}
+
+// RegisterErrorCode registers the error of the code.
+// If a handler returns an error which errors.Is the registered error, the peer receives the code,
+// and the RemoteError of the code matches the registered error by errors.Is.
+// If the error matches several registered errors, the code which is registered first is used.
+// It panics if the code is already registered
+func RegisterErrorCode(code uint32, err error){
+	if err == nil {
+		panic("err cannot be nil")
+	}
+	errorCodes.Lock()
+	defer errorCodes.Unlock()
+	if _, ok := errorCodes.m[code]; ok {
+		panic(fmt.Sprintf("pio: error code 0x%02x already registered", code))
+	}
+	errorCodes.m[code] = err
+	errorCodes.order = append(errorCodes.order, code)
+}
+
+func registeredError(code uint32)(error){
+	errorCodes.RLock()
+	defer errorCodes.RUnlock()
+	return errorCodes.m[code]
+}
+
+// codeOf returns the first registered code of err, or ErrCodeInternal
+func codeOf(err error)(uint32){
+	errorCodes.RLock()
+	defer errorCodes.RUnlock()
+	for _, code := range errorCodes.order {
+		if code != ErrCodeInternal && errors.Is(err, errorCodes.m[code]) {
+			return code
+		}
+	}
+	return ErrCodeInternal
+}
+
+// RemoteError is returned by Ask when the peer replied an error.
+// A handler can also return a *RemoteError to control the code and the details that the peer receives
+type RemoteError struct{
+	Code uint32
+	Message string
+	Details []byte
+}
+
+func NewRemoteError(code uint32, msg string, details []byte)(*RemoteError){
+	return &RemoteError{
+		Code: code,
+		Message: msg,
+		Details: details,
+	}
+}
+
+func (e *RemoteError)Error()(string){
+	return fmt.Sprintf("pio: remote error 0x%02x: %s", e.Code, e.Message)
+}
+
+// Unwrap returns the error registered with the code, so errors.Is and errors.As can match it
+func (e *RemoteError)Unwrap()(error){
+	return registeredError(e.Code)
+}
+
+type errorPkt struct{
+	Code uint32
+	Message string
+	Details []byte
+}
+
+var _ PacketBase = (*errorPkt)(nil)
+
+func (*errorPkt)PktId()(uint32){ return 0x03 }
+
+func (p *errorPkt)WriteTo(w encoding.Writer)(err error){
+	if err = w.WriteUint32(p.Code); err != nil {
+		return
+	}
+	if err = w.WriteString(p.Message); err != nil {
+		return
+	}
+	return w.WriteBytes(p.Details)
+}
+
+func (p *errorPkt)ParseFrom(r encoding.Reader)(err error){
+	if p.Code, err = r.ReadUint32(); err != nil {
+		return
+	}
+	if p.Message, err = r.ReadString(); err != nil {
+		return
+	}
+	p.Details, err = r.ReadBytes()
+	return
+}
+
+// errorPktOf returns the error packet which is replied for err.
+// The messages of the internal errors and the panics may contain the details of this side, so they are not sent
+func errorPktOf(err error)(*errorPkt){
+	var re *RemoteError
+	if errors.As(err, &re) {
+		return &errorPkt{Code: re.Code, Message: re.Message, Details: re.Details}
+	}
+	code := codeOf(err)
+	switch code {
+	case ErrCodeInternal:
+		return &errorPkt{Code: code, Message: "internal error"}
+	case ErrCodePanic:
+		return &errorPkt{Code: code, Message: "handler panicked"}
+	}
+	return &errorPkt{Code: code, Message: err.Error()}
+}
+
+// replyError replies the error to the ask of the id
+func (c *Conn)replyError(id uint32, err error)(error){
+	return c.send(errorPktOf(err), id, RecvAsk)
+}
@@ -0,0 +1,60 @@
+package pio
+
+import (
+	"context"
+	"reflect"
+)
+
+// handlerFunc handles a packet registered by Handle or HandleAsk, the result is the response of an ask
+type handlerFunc func(ctx context.Context, p PacketBase)(PacketBase, error)
+
+// newerOf returns the PacketNewer of T, which allocates a new value if T is a pointer type
+func newerOf[T PacketBase]()(PacketNewer){
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if t.Kind() == reflect.Pointer {
+		elem := t.Elem()
+		return func()(PacketBase){ return reflect.New(elem).Interface().(PacketBase) }
+	}
+	return func()(PacketBase){
+		var p T
+		return p
+	}
+}
+
+func (c *Conn)addHandler(newer PacketNewer, h handlerFunc){
+	c.AddPacket(newer)
+	c.handlers[newer().PktId()] = h
+}
+
+// Handle registers the packet type T and its handler, so the packet type itself does not need a Trigger method.
+// If T is a pointer type, a new value is allocated for every received packet.
+// The handler has the priority over the Trigger or TriggerContext methods of the packet.
+// If the packet is sent by Ask, the peer receives Ok after the handler returned.
+// Like AddPacket, it must be called before the Conn starts serving
+func Handle[T PacketBase](c *Conn, handler func(ctx context.Context, p T)(error)){
+	if handler == nil {
+		panic("handler cannot be nil")
+	}
+	c.addHandler(newerOf[T](), func(ctx context.Context, p PacketBase)(PacketBase, error){
+		return nil, handler(ctx, p.(T))
+	})
+}
+
+// HandleAsk registers the packet type Req and its handler which returns the response,
+// it's the typed version of the PacketAskContext interface, see Handle.
+// If the packet is sent by Send, the response is dropped
+func HandleAsk[Req, Resp PacketBase](c *Conn, handler func(ctx context.Context, p Req)(Resp, error)){
+	if handler == nil {
+		panic("handler cannot be nil")
+	}
+	c.addHandler(newerOf[Req](), func(ctx context.Context, p PacketBase)(res PacketBase, err error){
+		var r Resp
+		if r, err = handler(ctx, p.(Req)); err != nil {
+			return
+		}
+		if v := reflect.ValueOf(r); !v.IsValid() || v.Kind() == reflect.Pointer && v.IsNil() {
+			return nil, nil
+		}
+		return r, nil
+	})
+}
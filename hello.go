@@ -0,0 +1,157 @@
+package pio
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/kmcsr/go-pio/encoding"
+)
+
+// ProtocolVersion is the version of the pio protocol that is sent in the hello message
+const ProtocolVersion uint32 = 1
+
+// The hello message is exchanged after the authentication, in the same way as the authentication messages.
+// Its body is:
+//
+//   uint32    protocol version
+//   string    application name
+//   string    application version
+//   []string  features
+//   []uint32  registered packet ids, sorted
+
+// PeerInfo is the information that a peer sent in its hello message
+type PeerInfo struct{
+	Protocol uint32
+	App string
+	AppVersion string
+	Features []string
+	Packets []uint32
+
+	features map[string]struct{}
+	packets map[uint32]struct{}
+}
+
+func (p *PeerInfo)HasFeature(name string)(ok bool){
+	_, ok = p.features[name]
+	return
+}
+
+func (p *PeerInfo)HasPacket(id uint32)(ok bool){
+	_, ok = p.packets[id]
+	return
+}
+
+func (p *PeerInfo)WriteTo(w encoding.Writer)(err error){
+	if err = w.WriteUint32(p.Protocol); err != nil {
+		return
+	}
+	if err = w.WriteString(p.App); err != nil {
+		return
+	}
+	if err = w.WriteString(p.AppVersion); err != nil {
+		return
+	}
+	if err = encoding.WriteSlice(w, p.Features, encoding.Writer.WriteString); err != nil {
+		return
+	}
+	return w.WriteUint32s(p.Packets)
+}
+
+func (p *PeerInfo)ParseFrom(r encoding.Reader)(err error){
+	if p.Protocol, err = r.ReadUint32(); err != nil {
+		return
+	}
+	if p.App, err = r.ReadString(); err != nil {
+		return
+	}
+	if p.AppVersion, err = r.ReadString(); err != nil {
+		return
+	}
+	if p.Features, err = encoding.ReadSlice(r, encoding.Reader.ReadString); err != nil {
+		return
+	}
+	if p.Packets, err = r.ReadUint32s(); err != nil {
+		return
+	}
+	p.features = make(map[string]struct{}, len(p.Features))
+	for _, f := range p.Features {
+		p.features[f] = struct{}{}
+	}
+	p.packets = make(map[uint32]struct{}, len(p.Packets))
+	for _, id := range p.Packets {
+		p.packets[id] = struct{}{}
+	}
+	return
+}
+
+// UnsupportedPacketError is returned when the Conn only sends the packets that the peer advertised,
+// and the peer did not advertise the packet
+type UnsupportedPacketError struct{
+	PktId uint32
+}
+
+func (e *UnsupportedPacketError)Error()(string){
+	return fmt.Sprintf("pio: packet 0x%02x is not supported by the peer", e.PktId)
+}
+
+// PeerInfo returns the information of the peer, it's nil if the hello exchange is not enabled by WithHello.
+// It's valid after ServeDone is closed
+func (c *Conn)PeerInfo()(*PeerInfo){
+	c.statusmux.RLock()
+	defer c.statusmux.RUnlock()
+	return c.peer
+}
+
+// PeerSupports reports whether the peer advertised the packet.
+// It's always true if the hello exchange is not enabled
+func (c *Conn)PeerSupports(pid uint32)(bool){
+	peer := c.PeerInfo()
+	if peer == nil {
+		return true
+	}
+	return peer.HasPacket(pid)
+}
+
+// hello exchanges the hello messages
+func (c *Conn)hello()(err error){
+	info := *c.info
+	info.Protocol = ProtocolVersion
+	info.Packets = make([]uint32, 0, len(c.pkts))
+	for id := range c.pkts {
+		info.Packets = append(info.Packets, id)
+	}
+	sort.Slice(info.Packets, func(i, j int)(bool){ return info.Packets[i] < info.Packets[j] })
+
+	body := new(bytes.Buffer)
+	if err = info.WriteTo(encoding.WrapWriter(body, c.encOpts...)); err != nil {
+		return
+	}
+	msg := body.Bytes()
+	if c.secure != nil {
+		msg = c.secure.seal(msg)
+	}
+	out := new(bytes.Buffer)
+	encoding.WrapWriter(out, c.encOpts...).WriteBytes(msg)
+
+	peer := new(PeerInfo)
+	if err = c.exchange(out.Bytes(), func()(err error){
+		var msg []byte
+		if msg, err = c.readMessage(c.limits.MaxFrameSize); err != nil {
+			return
+		}
+		if err = peer.ParseFrom(encoding.NewSliceReader(msg, c.bodyOpts...)); err != nil {
+			return fmt.Errorf("pio: bad hello message: %w", err)
+		}
+		return
+	}); err != nil {
+		return
+	}
+	if peer.Protocol != ProtocolVersion {
+		return fmt.Errorf("pio: unsupported protocol version %d of the peer, expect %d", peer.Protocol, ProtocolVersion)
+	}
+	c.statusmux.Lock()
+	c.peer = peer
+	c.statusmux.Unlock()
+	return
+}
@@ -0,0 +1,500 @@
+// Package gen emits Go source which implements pio packets,
+// it is shared by the piogen and pioc commands.
+// The emitted encoding is the same as encoding.Marshal produces.
+package gen
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"sort"
+	"strings"
+)
+
+type Kind int
+
+const (
+	Bool Kind = iota
+	Uint8
+	Int8
+	Uint16
+	Int16
+	Uint32
+	Int32
+	Uint64
+	Int64
+	Float32
+	Float64
+	String
+	Slice
+	Array
+	Map
+	Pointer
+	Struct
+	// Std is a standard library type which is encoded by the encoding.Write<Std> and encoding.Read<Std> helpers
+	Std
+)
+
+// stdHelpers are the helpers of the Std kind, the value reports whether the Read helper returns a pointer
+var stdHelpers = map[string]bool{
+	"Time":     false,
+	"BigInt":   true,
+	"BigFloat": true,
+	"IP":       false,
+	"Addr":     false,
+	"AddrPort": false,
+	"UUID":     false,
+}
+
+type Type struct{
+	Kind Kind
+	// GoType is how the type is spelled in the generated code
+	GoType string
+	Elem *Type
+	Key *Type
+	// Varint reports whether the integer is encoded as varint
+	Varint bool
+	// Packed reports whether the []bool is encoded by encoding.WritePackedBools
+	Packed bool
+	// Message reports whether the struct is wrapped in a message, see encoding.Writer.WriteMessage
+	Message bool
+	// Std is the helper name of the Std kind, e.g. Time for encoding.WriteTime and encoding.ReadTime
+	Std string
+	// Import is the import spec of the package which GoType refers to, e.g. `"time"` or `mybig "math/big"`
+	Import string
+}
+
+type Field struct{
+	Name string
+	Type *Type
+}
+
+type Decl struct{
+	Name string
+	Fields []Field
+	// Declare reports whether the struct type itself should be generated
+	Declare bool
+	// IsPacket reports whether PktId should be generated
+	IsPacket bool
+	PktId uint32
+	// Response is the response type name of an ask packet,
+	// an Ask method which calls the Handle<Name> variable will be generated if it's not empty
+	Response string
+}
+
+type File struct{
+	Package string
+	Generator string
+	Decls []*Decl
+	// Register is the name of the function which adds all packets to a pio.Conn,
+	// it will not be generated if it's empty
+	Register string
+}
+
+type primitive struct{
+	method string
+	base string
+}
+
+var primitives = map[Kind]primitive{
+	Bool:    {"Bool", "bool"},
+	Uint8:   {"Byte", "byte"},
+	Int8:    {"Int8", "int8"},
+	Uint16:  {"Uint16", "uint16"},
+	Int16:   {"Int16", "int16"},
+	Uint32:  {"Uint32", "uint32"},
+	Int32:   {"Int32", "int32"},
+	Uint64:  {"Uint64", "uint64"},
+	Int64:   {"Int64", "int64"},
+	Float32: {"Float32", "float32"},
+	Float64: {"Float64", "float64"},
+	String:  {"String", "string"},
+}
+
+// sliceHelpers are the element types which have packed slice methods on encoding.Reader and encoding.Writer
+var sliceHelpers = map[string]primitive{
+	"byte":    {"Bytes", "[]byte"},
+	"uint8":   {"Bytes", "[]byte"},
+	"bool":    {"Bools", "[]bool"},
+	"uint16":  {"Uint16s", "[]uint16"},
+	"uint32":  {"Uint32s", "[]uint32"},
+	"uint64":  {"Uint64s", "[]uint64"},
+	"int8":    {"Int8s", "[]int8"},
+	"int16":   {"Int16s", "[]int16"},
+	"int32":   {"Int32s", "[]int32"},
+	"int64":   {"Int64s", "[]int64"},
+	"float32": {"Float32s", "[]float32"},
+	"float64": {"Float64s", "[]float64"},
+}
+
+// varintBase are the integer kinds which are narrower than the decoded varint
+var varintBase = map[Kind]string{
+	Uint8:  "uint8",
+	Int8:   "int8",
+	Uint16: "uint16",
+	Int16:  "int16",
+	Uint32: "uint32",
+	Int32:  "int32",
+}
+
+func primitiveOf(t *Type)(p primitive, ok bool){
+	if t.Varint {
+		switch t.Kind {
+		case Uint8, Uint16, Uint32, Uint64:
+			return primitive{"VarUint", "uint64"}, true
+		case Int8, Int16, Int32, Int64:
+			return primitive{"VarInt", "int64"}, true
+		}
+	}
+	if t.Kind == Slice {
+		p, ok = sliceHelpers[t.Elem.GoType]
+		return
+	}
+	p, ok = primitives[t.Kind]
+	return
+}
+
+// tag returns the pio struct tag option which makes encoding.Marshal use the same encoding
+func (t *Type)tag()(string){
+	switch {
+	case t.Varint:
+		return "varint"
+	case t.Packed:
+		return "packed"
+	case t.Message:
+		return "message"
+	}
+	return ""
+}
+
+type emitter struct{
+	buf bytes.Buffer
+	indent int
+	tmp int
+	imports map[string]bool
+	// field is the name of the field which is being read, it's used by the error messages
+	field string
+}
+
+// typ returns the GoType of t, and records the imports which it needs
+func (e *emitter)typ(t *Type)(string){
+	e.use(t)
+	return t.GoType
+}
+
+func (e *emitter)use(t *Type){
+	if t == nil {
+		return
+	}
+	if t.Import != "" {
+		if e.imports == nil {
+			e.imports = make(map[string]bool)
+		}
+		e.imports[t.Import] = true
+	}
+	e.use(t.Key)
+	e.use(t.Elem)
+}
+
+func (e *emitter)line(format string, args ...any){
+	e.buf.WriteString(strings.Repeat("\t", e.indent))
+	fmt.Fprintf(&e.buf, format, args...)
+	e.buf.WriteByte('\n')
+}
+
+func (e *emitter)open(format string, args ...any){
+	e.line(format, args...)
+	e.indent++
+}
+
+func (e *emitter)close(){
+	e.indent--
+	e.line("}")
+}
+
+func (e *emitter)check(format string, args ...any){
+	e.open("if " + format + "; err != nil {", args...)
+	e.line("return")
+	e.close()
+}
+
+func (e *emitter)name(prefix string)(string){
+	e.tmp++
+	return fmt.Sprintf("%s%d", prefix, e.tmp)
+}
+
+func (e *emitter)writeValue(expr string, t *Type){
+	if t.Packed {
+		e.check("err = encoding.WritePackedBools(w, %s)", expr)
+		return
+	}
+	if p, ok := primitiveOf(t); ok {
+		if t.GoType != p.base {
+			expr = "(" + p.base + ")(" + expr + ")"
+		}
+		e.check("err = w.Write%s(%s)", p.method, expr)
+		return
+	}
+	switch t.Kind {
+	case Slice:
+		e.check("err = w.WriteLength((uint32)(len(%s)))", expr)
+		i := e.name("i")
+		e.open("for %s := range %s {", i, expr)
+		e.writeValue(expr + "[" + i + "]", t.Elem)
+		e.close()
+	case Array:
+		i := e.name("i")
+		e.open("for %s := range %s {", i, expr)
+		e.writeValue(expr + "[" + i + "]", t.Elem)
+		e.close()
+	case Map:
+		e.check("err = w.WriteLength((uint32)(len(%s)))", expr)
+		k, v := e.name("k"), e.name("v")
+		e.open("for %s, %s := range %s {", k, v, expr)
+		e.writeValue(k, t.Key)
+		e.writeValue(v, t.Elem)
+		e.close()
+	case Pointer:
+		e.check("err = w.WriteBool(%s != nil)", expr)
+		e.open("if %s != nil {", expr)
+		e.writeValue("(*" + expr + ")", t.Elem)
+		e.close()
+	case Struct:
+		if t.Message {
+			e.check("err = w.WriteMessage(%s.WriteTo)", expr)
+			return
+		}
+		e.check("err = %s.WriteTo(w)", expr)
+	case Std:
+		if stdHelpers[t.Std] {
+			expr = "&" + expr
+		}
+		e.check("err = encoding.Write%s(w, %s)", t.Std, expr)
+	default:
+		panic(fmt.Sprintf("gen: unexpected kind %d", t.Kind))
+	}
+}
+
+func (e *emitter)readValue(expr string, t *Type){
+	if t.Packed {
+		e.check("%s, err = encoding.ReadPackedBools(r)", expr)
+		return
+	}
+	if p, ok := primitiveOf(t); ok {
+		if t.GoType == p.base {
+			e.check("%s, err = r.Read%s()", expr, p.method)
+			return
+		}
+		v := e.name("v")
+		e.open("{")
+		e.line("var %s %s", v, p.base)
+		e.check("%s, err = r.Read%s()", v, p.method)
+		if b, ok := varintBase[t.Kind]; ok && t.Varint {
+			// the same check and error as encoding.Unmarshal
+			e.use(&Type{Import: `"fmt"`})
+			e.open("if (%s)((%s)(%s)) != %s {", p.base, b, v, v)
+			e.line("return fmt.Errorf(%q, %q, %s, %s)", "encoding: field %s: value %d overflows %T", e.field, v, expr)
+			e.close()
+		}
+		e.line("%s = (%s)(%s)", expr, e.typ(t), v)
+		e.close()
+		return
+	}
+	switch t.Kind {
+	case Slice:
+		l, i, v := e.name("l"), e.name("i"), e.name("v")
+		e.open("{")
+		e.line("var %s uint32", l)
+		e.check("%s, err = r.ReadLength()", l)
+		e.line("%s = make(%s, 0, encoding.PreallocCap[%s](%s))", expr, e.typ(t), t.Elem.GoType, l)
+		e.open("for %s := (uint32)(0); %s < %s; %s++ {", i, i, l, i)
+		e.line("var %s %s", v, t.Elem.GoType)
+		e.readValue(v, t.Elem)
+		e.line("%s = append(%s, %s)", expr, expr, v)
+		e.close()
+		e.close()
+	case Array:
+		i := e.name("i")
+		e.open("for %s := range %s {", i, expr)
+		e.readValue(expr + "[" + i + "]", t.Elem)
+		e.close()
+	case Map:
+		l, n, k, v := e.name("l"), e.name("n"), e.name("k"), e.name("v")
+		e.open("{")
+		e.line("var %s uint32", l)
+		e.check("%s, err = r.ReadLength()", l)
+		e.line("%s = make(%s, encoding.PreallocMapCap[%s, %s](%s))", expr, e.typ(t), t.Key.GoType, t.Elem.GoType, l)
+		e.open("for %s := (uint32)(0); %s < %s; %s++ {", n, n, l, n)
+		e.line("var %s %s", k, t.Key.GoType)
+		e.line("var %s %s", v, t.Elem.GoType)
+		e.readValue(k, t.Key)
+		e.readValue(v, t.Elem)
+		e.line("%s[%s] = %s", expr, k, v)
+		e.close()
+		e.close()
+	case Pointer:
+		ok := e.name("ok")
+		e.open("{")
+		e.line("var %s bool", ok)
+		e.check("%s, err = r.ReadBool()", ok)
+		e.open("if %s {", ok)
+		e.line("%s = new(%s)", expr, e.typ(t.Elem))
+		e.readValue("(*" + expr + ")", t.Elem)
+		e.indent--
+		e.open("}else{")
+		e.line("%s = nil", expr)
+		e.close()
+		e.close()
+	case Struct:
+		if t.Message {
+			e.check("err = encoding.ParseMessage(r, %s.ParseFrom)", expr)
+			return
+		}
+		e.check("err = %s.ParseFrom(r)", expr)
+	case Std:
+		if !stdHelpers[t.Std] {
+			e.check("%s, err = encoding.Read%s(r)", expr, t.Std)
+			return
+		}
+		v := e.name("v")
+		e.open("{")
+		e.line("var %s *%s", v, e.typ(t))
+		e.check("%s, err = encoding.Read%s(r)", v, t.Std)
+		e.line("%s = *%s", expr, v)
+		e.close()
+	default:
+		panic(fmt.Sprintf("gen: unexpected kind %d", t.Kind))
+	}
+}
+
+func (e *emitter)emitStruct(s *Decl){
+	if s.Declare {
+		e.open("type %s struct{", s.Name)
+		for _, f := range s.Fields {
+			if tag := f.Type.tag(); tag != "" {
+				e.line("%s %s `pio:%q`", f.Name, e.typ(f.Type), tag)
+			}else{
+				e.line("%s %s", f.Name, e.typ(f.Type))
+			}
+		}
+		e.close()
+		e.line("")
+	}
+	if s.IsPacket {
+		e.line("func (*%s)PktId()(uint32){ return 0x%02x }", s.Name, s.PktId)
+		e.line("")
+	}
+	e.open("func (p *%s)WriteTo(w encoding.Writer)(err error){", s.Name)
+	for _, f := range s.Fields {
+		e.writeValue("p." + f.Name, f.Type)
+	}
+	e.line("return")
+	e.close()
+	e.line("")
+	e.open("func (p *%s)ParseFrom(r encoding.Reader)(err error){", s.Name)
+	for _, f := range s.Fields {
+		e.field = s.Name + "." + f.Name
+		e.readValue("p." + f.Name, f.Type)
+	}
+	e.line("return")
+	e.close()
+	e.line("")
+	if s.Response != "" {
+		e.line("// Handle%s handles the received %s packets", s.Name, s.Name)
+		e.line("var Handle%s func(p *%s)(*%s, error)", s.Name, s.Name, s.Response)
+		e.line("")
+		e.open("func (p *%s)Ask()(pio.PacketBase, error){", s.Name)
+		e.open("if Handle%s == nil {", s.Name)
+		e.line("return nil, errors.New(%q)", "Handle" + s.Name + " is not set")
+		e.close()
+		// a nil *Resp must not become a non-nil pio.PacketBase
+		e.line("res, err := Handle%s(p)", s.Name)
+		e.open("if err != nil || res == nil {")
+		e.line("return nil, err")
+		e.close()
+		e.line("return res, nil")
+		e.close()
+		e.line("")
+		e.line("func (*%s)ResponsePktId()(uint32){ return (*%s)(nil).PktId() }", s.Name, s.Response)
+		e.line("")
+	}
+}
+
+// Generate returns the formatted source of the file
+func Generate(f *File)(src []byte, err error){
+	var (
+		e, body emitter
+		packets []*Decl
+		asks bool
+	)
+	for _, s := range f.Decls {
+		if s.IsPacket {
+			packets = append(packets, s)
+		}
+		if s.Response != "" {
+			asks = true
+		}
+	}
+	generator := f.Generator
+	if generator == "" {
+		generator = "gen"
+	}
+	e.line("// Code generated by %s. DO NOT EDIT.", generator)
+	e.line("")
+	e.line("package %s", f.Package)
+	e.line("")
+	// the declarations are emitted first to know which packages they refer to
+	for _, s := range f.Decls {
+		body.emitStruct(s)
+	}
+	if f.Register != "" && len(packets) > 0 {
+		body.open("func %s(c *pio.Conn){", f.Register)
+		for _, s := range packets {
+			body.line("c.AddPacket(func()(pio.PacketBase){ return new(%s) })", s.Name)
+		}
+		body.close()
+	}
+	delete(body.imports, `"errors"`)
+	delete(body.imports, `"github.com/kmcsr/go-pio/encoding"`)
+	usePio := asks || (f.Register != "" && len(packets) > 0)
+	if usePio {
+		delete(body.imports, `"github.com/kmcsr/go-pio"`)
+	}
+	var std, others []string
+	for spec := range body.imports {
+		// the paths of the standard library have no dot in the first element
+		p := spec[strings.IndexByte(spec, '"') + 1:]
+		if first, _, _ := strings.Cut(p, "/"); strings.Contains(first, ".") {
+			others = append(others, spec)
+		}else{
+			std = append(std, spec)
+		}
+	}
+	if asks {
+		std = append(std, `"errors"`)
+	}
+	if usePio {
+		others = append(others, `"github.com/kmcsr/go-pio"`)
+	}
+	others = append(others, `"github.com/kmcsr/go-pio/encoding"`)
+	sort.Strings(std)
+	sort.Strings(others)
+	e.open("import (")
+	for _, spec := range std {
+		e.line("%s", spec)
+	}
+	if len(std) > 0 {
+		e.line("")
+	}
+	for _, spec := range others {
+		e.line("%s", spec)
+	}
+	e.indent--
+	e.line(")")
+	e.line("")
+	e.buf.Write(body.buf.Bytes())
+	if src, err = format.Source(e.buf.Bytes()); err != nil {
+		return nil, fmt.Errorf("gen: format generated source: %w\n%s", err, e.buf.Bytes())
+	}
+	return
+}
@@ -0,0 +1,181 @@
+package pio
+
+import (
+	"compress/flate"
+	"crypto/ecdh"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+
+	"github.com/kmcsr/go-pio/encoding"
+)
+
+// ConnOption configures a Conn when it's created
+type ConnOption func(*Conn)
+
+// WithEncoding sets the options of the frame reader and writer and the packet bodies.
+// Both peers must use the same encoding options
+func WithEncoding(opts ...encoding.Option)(ConnOption){
+	return func(c *Conn){
+		c.encOpts = append(c.encOpts, opts...)
+	}
+}
+
+// WithByteOrder makes the whole connection use the byte order
+func WithByteOrder(order binary.ByteOrder)(ConnOption){
+	return WithEncoding(encoding.WithByteOrder(order))
+}
+
+// WithLimits makes the Conn drop the peer when a frame or a packet body exceeds the limits,
+// Serve will return the *encoding.LimitError
+func WithLimits(limits encoding.Limits)(ConnOption){
+	return func(c *Conn){
+		c.limits = limits
+	}
+}
+
+// WithChecksum appends a checksum of the body to every frame, and checks the checksum of the received frames before parsing them.
+// The length prefix of a frame counts the checksum too. Both peers must use the same hash.
+// A frame with a wrong checksum is dropped and reported to Conn.OnChecksumError,
+// see WithCloseOnChecksumError for closing the connection instead.
+func WithChecksum(newHash func()(hash.Hash))(ConnOption){
+	if newHash == nil {
+		panic("newHash cannot be nil")
+	}
+	return func(c *Conn){
+		c.newHash = newHash
+	}
+}
+
+// WithCRC32C is WithChecksum with CRC-32 using the Castagnoli polynomial
+func WithCRC32C()(ConnOption){
+	return WithChecksum(func()(hash.Hash){ return crc32.New(castagnoliTable) })
+}
+
+// WithCloseOnChecksumError makes the Conn close itself and Serve return the *ChecksumError when a frame has a wrong checksum,
+// instead of dropping the frame and continuing. The pending asks and the later sends fail after that
+func WithCloseOnChecksumError()(ConnOption){
+	return func(c *Conn){
+		c.closeOnChecksum = true
+	}
+}
+
+// WithCompression compresses the payload of the frames which payload is at least threshold bytes,
+// if the compressed payload is smaller. The compressed frames are marked by the Compressed bit of the ask byte.
+// A nil comp uses flate with the default compression level. Both peers must use the same compressor.
+// A decompressed payload cannot be larger than the MaxFrameSize limit, or DefaultMaxDecompressed if it's not set,
+// Serve returns the *encoding.LimitError otherwise.
+func WithCompression(comp Compressor, threshold int)(ConnOption){
+	if comp == nil {
+		comp = NewFlateCompressor(flate.DefaultCompression)
+	}
+	return func(c *Conn){
+		c.compressor = comp
+		c.compressMin = threshold
+		c.compStats = new(CompressionStats)
+	}
+}
+
+// WithEncryption makes the Conn exchange the keys when it starts serving, and encrypt every frame with AES-GCM.
+// Serve returns the error if the handshake fails, and no packet can be sent before the handshake completed,
+// Send returns the error of the handshake if it failed.
+// A nil cfg is the zero SecureConfig. The streams of AsStream are encrypted too. Both peers must use encryption.
+func WithEncryption(cfg *SecureConfig)(ConnOption){
+	if cfg == nil {
+		cfg = new(SecureConfig)
+	}
+	if (cfg.StaticKey == nil) != (cfg.PeerKey == nil) {
+		panic("StaticKey and PeerKey must be set together")
+	}
+	if cfg.StaticKey != nil && (cfg.StaticKey.Curve() != ecdh.X25519() || cfg.PeerKey.Curve() != ecdh.X25519()) {
+		panic("StaticKey and PeerKey must be X25519 keys")
+	}
+	return func(c *Conn){
+		c.secure = &secureState{
+			cfg: cfg,
+		}
+	}
+}
+
+// WithAuthenticator makes the Conn authenticate the peer when it starts serving, after the secure handshake.
+// No packet is sent or dispatched before the authentication succeeded.
+// If it fails, Serve closes the Conn and returns an *AuthError, and the peer receives the reason.
+// The identity of the peer is stored on the Conn, see Conn.Identity
+func WithAuthenticator(a Authenticator)(ConnOption){
+	if a == nil {
+		panic("a cannot be nil")
+	}
+	return func(c *Conn){
+		c.auth = a
+	}
+}
+
+// WithHello makes the Conn exchange the hello messages when it starts serving, after the authentication.
+// The hello message contains the protocol version, the application name and version, the features,
+// and the ids of the packets that are added to the Conn before Serve. See Conn.PeerInfo
+func WithHello(app string, appVersion string, features ...string)(ConnOption){
+	return func(c *Conn){
+		c.info = &PeerInfo{
+			App: app,
+			AppVersion: appVersion,
+			Features: features,
+		}
+	}
+}
+
+// WithPeerPacketsOnly makes Send and Ask fail with *UnsupportedPacketError
+// if the peer did not advertise the packet in its hello message, it requires WithHello
+func WithPeerPacketsOnly()(ConnOption){
+	return func(c *Conn){
+		c.peerOnly = true
+	}
+}
+
+// WithMaxStreams sets the max number of the streams that the peer can open at the same time, the default is DefaultMaxStreams.
+// The stream heads which exceed the limit are rejected with ErrTooManyStreams, see Conn.SendStream
+func WithMaxStreams(n int)(ConnOption){
+	if n <= 0 {
+		panic("n must be positive")
+	}
+	return func(c *Conn){
+		c.maxStreams = n
+	}
+}
+
+// WithWorkers makes the Conn run the handlers of the received packets (Trigger, Ask and their variants)
+// in a pool of n workers instead of the serving goroutine, so a slow handler does not block other packets.
+// The responses of asks, the stream chunks and the stream switch are still handled by the serving goroutine.
+// The serving goroutine stops reading frames while the queue of queue packets is full. See Conn.DispatchStats.
+// The stream switch waits for the running handlers, the asks which they send fail with ErrStreamed,
+// and Serve returns ErrStreamDrain if they still do not return in 10 seconds
+func WithWorkers(n int, queue int)(ConnOption){
+	if n <= 0 {
+		panic("n must be positive")
+	}
+	if queue < 0 {
+		panic("queue cannot be negative")
+	}
+	return func(c *Conn){
+		c.workers = n
+		c.queueSize = queue
+	}
+}
+
+// WithOrderKey makes the handlers of the packets which have the same order key run in the received order,
+// the packets that fn returns false for run in any order. It requires WithWorkers
+func WithOrderKey(fn func(p PacketBase)(key uint64, ok bool))(ConnOption){
+	if fn == nil {
+		panic("fn cannot be nil")
+	}
+	return func(c *Conn){
+		c.orderKey = fn
+	}
+}
+
+// WithOrderByPacket makes the handlers of the packets of the same packet id run in the received order,
+// it requires WithWorkers
+func WithOrderByPacket()(ConnOption){
+	return WithOrderKey(func(p PacketBase)(uint64, bool){
+		return (uint64)(p.PktId()), true
+	})
+}
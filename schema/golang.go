@@ -0,0 +1,86 @@
+package schema
+
+import (
+	"fmt"
+
+	"github.com/kmcsr/go-pio/internal/gen"
+)
+
+// GenerateGo returns the Go source which declares the types of the schema with their pio methods.
+// The function which adds all packets to a pio.Conn is named register, it's not generated if register is empty.
+func (f *File)GenerateGo(register string)([]byte, error){
+	file := &gen.File{
+		Package: f.Package,
+		Generator: "pioc",
+		Register: register,
+	}
+	for _, d := range f.Decls {
+		gd := &gen.Decl{
+			Name: GoName(d.Name),
+			Declare: true,
+			IsPacket: d.IsPacket,
+			PktId: d.Id,
+		}
+		if d.Response != "" {
+			gd.Response = GoName(d.Response)
+		}
+		for _, fd := range d.Fields {
+			gd.Fields = append(gd.Fields, gen.Field{
+				Name: GoName(fd.Name),
+				Type: goType(fd.Type),
+			})
+		}
+		file.Decls = append(file.Decls, gd)
+	}
+	return gen.Generate(file)
+}
+
+func goType(t *Type)(g *gen.Type){
+	switch t.Kind {
+	case Bool:
+		return &gen.Type{Kind: gen.Bool, GoType: "bool"}
+	case Uint8:
+		return &gen.Type{Kind: gen.Uint8, GoType: "byte"}
+	case Int8:
+		return &gen.Type{Kind: gen.Int8, GoType: "int8"}
+	case Uint16:
+		return &gen.Type{Kind: gen.Uint16, GoType: "uint16"}
+	case Int16:
+		return &gen.Type{Kind: gen.Int16, GoType: "int16"}
+	case Uint32:
+		return &gen.Type{Kind: gen.Uint32, GoType: "uint32"}
+	case Int32:
+		return &gen.Type{Kind: gen.Int32, GoType: "int32"}
+	case Uint64:
+		return &gen.Type{Kind: gen.Uint64, GoType: "uint64"}
+	case Int64:
+		return &gen.Type{Kind: gen.Int64, GoType: "int64"}
+	case Float32:
+		return &gen.Type{Kind: gen.Float32, GoType: "float32"}
+	case Float64:
+		return &gen.Type{Kind: gen.Float64, GoType: "float64"}
+	case String:
+		return &gen.Type{Kind: gen.String, GoType: "string"}
+	case Bytes:
+		return &gen.Type{Kind: gen.Slice, GoType: "[]byte", Elem: &gen.Type{Kind: gen.Uint8, GoType: "byte"}}
+	case VarUint:
+		return &gen.Type{Kind: gen.Uint64, GoType: "uint64", Varint: true}
+	case VarInt:
+		return &gen.Type{Kind: gen.Int64, GoType: "int64", Varint: true}
+	case Slice:
+		elem := goType(t.Elem)
+		return &gen.Type{Kind: gen.Slice, GoType: "[]" + elem.GoType, Elem: elem}
+	case Array:
+		elem := goType(t.Elem)
+		return &gen.Type{Kind: gen.Array, GoType: fmt.Sprintf("[%d]%s", t.Len, elem.GoType), Elem: elem}
+	case Map:
+		key, elem := goType(t.Key), goType(t.Elem)
+		return &gen.Type{Kind: gen.Map, GoType: "map[" + key.GoType + "]" + elem.GoType, Key: key, Elem: elem}
+	case Optional:
+		elem := goType(t.Elem)
+		return &gen.Type{Kind: gen.Pointer, GoType: "*" + elem.GoType, Elem: elem}
+	case Named:
+		return &gen.Type{Kind: gen.Struct, GoType: GoName(t.Name)}
+	}
+	panic("schema: unexpected kind " + (string)(t.Kind))
+}
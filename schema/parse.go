@@ -0,0 +1,278 @@
+package schema
+
+import (
+	"fmt"
+	"strconv"
+)
+
+type SyntaxError struct{
+	Filename string
+	Line int
+	Msg string
+}
+
+func (e *SyntaxError)Error()(string){
+	return fmt.Sprintf("%s:%d: %s", e.Filename, e.Line, e.Msg)
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokSymbol
+)
+
+type token struct{
+	kind tokenKind
+	text string
+	line int
+}
+
+type parser struct{
+	filename string
+	src []byte
+	pos int
+	line int
+	tok token
+}
+
+// Parse parses and checks a schema file
+func Parse(filename string, src []byte)(f *File, err error){
+	p := &parser{
+		filename: filename,
+		src: src,
+		line: 1,
+	}
+	defer func(){
+		if e := recover(); e != nil {
+			se, ok := e.(*SyntaxError)
+			if !ok {
+				panic(e)
+			}
+			f, err = nil, se
+		}
+	}()
+	p.next()
+	f = p.parseFile()
+	p.check(f)
+	return
+}
+
+func (p *parser)errorf(line int, format string, args ...any){
+	panic(&SyntaxError{p.filename, line, fmt.Sprintf(format, args...)})
+}
+
+func isLetter(c byte)(bool){
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isDigit(c byte)(bool){
+	return '0' <= c && c <= '9'
+}
+
+func (p *parser)next(){
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '\n' {
+			p.line++
+			p.pos++
+		}else if c == ' ' || c == '\t' || c == '\r' || c == ';' {
+			p.pos++
+		}else if c == '#' || c == '/' && p.pos + 1 < len(p.src) && p.src[p.pos + 1] == '/' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		}else{
+			break
+		}
+	}
+	if p.pos >= len(p.src) {
+		p.tok = token{tokEOF, "", p.line}
+		return
+	}
+	start := p.pos
+	c := p.src[p.pos]
+	switch {
+	case isLetter(c):
+		for p.pos < len(p.src) && (isLetter(p.src[p.pos]) || isDigit(p.src[p.pos])) {
+			p.pos++
+		}
+		p.tok = token{tokIdent, (string)(p.src[start:p.pos]), p.line}
+	case isDigit(c):
+		for p.pos < len(p.src) && (isLetter(p.src[p.pos]) || isDigit(p.src[p.pos])) {
+			p.pos++
+		}
+		p.tok = token{tokNumber, (string)(p.src[start:p.pos]), p.line}
+	case c == '-' && p.pos + 1 < len(p.src) && p.src[p.pos + 1] == '>':
+		p.pos += 2
+		p.tok = token{tokSymbol, "->", p.line}
+	case c == '{' || c == '}' || c == '[' || c == ']' || c == '=' || c == '?':
+		p.pos++
+		p.tok = token{tokSymbol, (string)(c), p.line}
+	default:
+		p.errorf(p.line, "unexpected character %q", c)
+	}
+}
+
+func (p *parser)expect(kind tokenKind, text string)(t token){
+	t = p.tok
+	if t.kind != kind || (text != "" && t.text != text) {
+		want := text
+		if want == "" {
+			want = map[tokenKind]string{tokIdent: "identifier", tokNumber: "number"}[kind]
+		}
+		got := t.text
+		if t.kind == tokEOF {
+			got = "EOF"
+		}
+		p.errorf(t.line, "expected %s, got %q", want, got)
+	}
+	p.next()
+	return
+}
+
+func (p *parser)number()(n uint64){
+	t := p.expect(tokNumber, "")
+	n, err := strconv.ParseUint(t.text, 0, 32)
+	if err != nil {
+		p.errorf(t.line, "bad number %q", t.text)
+	}
+	return
+}
+
+func (p *parser)parseFile()(f *File){
+	f = new(File)
+	p.expect(tokIdent, "package")
+	f.Package = p.expect(tokIdent, "").text
+	for p.tok.kind != tokEOF {
+		f.Decls = append(f.Decls, p.parseDecl())
+	}
+	return
+}
+
+func (p *parser)parseDecl()(d *Decl){
+	d = &Decl{
+		Line: p.tok.line,
+	}
+	switch p.tok.text {
+	case "struct":
+		p.next()
+		d.Name = p.expect(tokIdent, "").text
+	case "packet":
+		p.next()
+		d.IsPacket = true
+		d.Name = p.expect(tokIdent, "").text
+		p.expect(tokSymbol, "=")
+		d.Id = (uint32)(p.number())
+		if p.tok.kind == tokSymbol && p.tok.text == "->" {
+			p.next()
+			d.Response = p.expect(tokIdent, "").text
+		}
+	default:
+		p.errorf(p.tok.line, "expected struct or packet, got %q", p.tok.text)
+	}
+	p.expect(tokSymbol, "{")
+	for !(p.tok.kind == tokSymbol && p.tok.text == "}") {
+		line := p.tok.line
+		name := p.expect(tokIdent, "").text
+		d.Fields = append(d.Fields, &Field{
+			Name: name,
+			Type: p.parseType(),
+			Line: line,
+		})
+	}
+	p.next()
+	return
+}
+
+func (p *parser)parseType()(t *Type){
+	tok := p.tok
+	switch {
+	case tok.kind == tokSymbol && tok.text == "?":
+		p.next()
+		return &Type{Kind: Optional, Elem: p.parseType()}
+	case tok.kind == tokSymbol && tok.text == "[":
+		p.next()
+		if p.tok.kind == tokSymbol && p.tok.text == "]" {
+			p.next()
+			return &Type{Kind: Slice, Elem: p.parseType()}
+		}
+		n := p.number()
+		p.expect(tokSymbol, "]")
+		return &Type{Kind: Array, Len: (int)(n), Elem: p.parseType()}
+	case tok.kind == tokIdent && tok.text == "map":
+		p.next()
+		p.expect(tokSymbol, "[")
+		key := p.parseType()
+		p.expect(tokSymbol, "]")
+		return &Type{Kind: Map, Key: key, Elem: p.parseType()}
+	case tok.kind == tokIdent:
+		p.next()
+		if k, ok := primitives[tok.text]; ok {
+			return &Type{Kind: k}
+		}
+		return &Type{Kind: Named, Name: tok.text}
+	}
+	p.errorf(tok.line, "expected type, got %q", tok.text)
+	return
+}
+
+func (p *parser)check(f *File){
+	names := make(map[string]*Decl)
+	ids := make(map[uint32]*Decl)
+	goNames := make(map[string]*Decl)
+	for _, d := range f.Decls {
+		if o, ok := names[d.Name]; ok {
+			p.errorf(d.Line, "%s redeclared, previous declaration at line %d", d.Name, o.Line)
+		}
+		if o, ok := goNames[GoName(d.Name)]; ok {
+			p.errorf(d.Line, "%s and %s have the same Go name", d.Name, o.Name)
+		}
+		names[d.Name] = d
+		goNames[GoName(d.Name)] = d
+		if d.IsPacket {
+			if o, ok := ids[d.Id]; ok {
+				p.errorf(d.Line, "packet id 0x%02x of %s is already used by %s", d.Id, d.Name, o.Name)
+			}
+			ids[d.Id] = d
+		}
+	}
+	for _, d := range f.Decls {
+		if d.Response != "" {
+			if r, ok := names[d.Response]; !ok || !r.IsPacket {
+				p.errorf(d.Line, "response %s of %s is not a packet", d.Response, d.Name)
+			}
+		}
+		fields := make(map[string]bool)
+		for _, fd := range d.Fields {
+			if fields[GoName(fd.Name)] {
+				p.errorf(fd.Line, "field %s of %s redeclared", fd.Name, d.Name)
+			}
+			fields[GoName(fd.Name)] = true
+			p.checkType(fd, fd.Type, names)
+		}
+	}
+}
+
+func (p *parser)checkType(fd *Field, t *Type, names map[string]*Decl){
+	switch t.Kind {
+	case Named:
+		if _, ok := names[t.Name]; !ok {
+			p.errorf(fd.Line, "unknown type %s", t.Name)
+		}
+	case Map:
+		if !t.Key.Kind.IsPrimitive() || t.Key.Kind == Bytes {
+			p.errorf(fd.Line, "map key type %s is not a primitive type", t.Key)
+		}
+		p.checkType(fd, t.Elem, names)
+	case Optional:
+		if t.Elem.Kind == Optional {
+			p.errorf(fd.Line, "optional of optional type %s", t)
+		}
+		p.checkType(fd, t.Elem, names)
+	case Slice, Array:
+		p.checkType(fd, t.Elem, names)
+	}
+}
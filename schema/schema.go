@@ -0,0 +1,171 @@
+// Package schema parses the pio schema language, which describes packets independent of Go.
+//
+// A schema file looks like:
+//
+//	# comments start with '#' or '//'
+//	package demo
+//
+//	struct Vec {
+//		x float32
+//		y float32
+//	}
+//
+//	packet Move = 0x20 {
+//		id varint
+//		pos Vec
+//		path []Vec
+//		target ?Vec
+//		tags map[string]uint32
+//		grid [2][2]int16
+//	}
+//
+//	packet GetUser = 0x21 -> User {
+//		id uint64
+//	}
+//
+//	packet User = 0x22 {
+//		name string
+//	}
+//
+// The primitive types are bool, byte (uint8), int8, uint16, int16, uint32, int32, uint64, int64,
+// float32, float64, string, bytes, varuint and varint.
+// []T is a length prefixed slice, [N]T is an array without length prefix,
+// map[K]V is a length prefixed list of key value pairs, and ?T is a presence byte followed by T if it's present.
+// A packet with "-> Response" is an ask packet, the peer replies it with the response packet.
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+type Kind string
+
+const (
+	Bool     Kind = "bool"
+	Uint8    Kind = "uint8"
+	Int8     Kind = "int8"
+	Uint16   Kind = "uint16"
+	Int16    Kind = "int16"
+	Uint32   Kind = "uint32"
+	Int32    Kind = "int32"
+	Uint64   Kind = "uint64"
+	Int64    Kind = "int64"
+	Float32  Kind = "float32"
+	Float64  Kind = "float64"
+	String   Kind = "string"
+	Bytes    Kind = "bytes"
+	VarUint  Kind = "varuint"
+	VarInt   Kind = "varint"
+	Slice    Kind = "slice"
+	Array    Kind = "array"
+	Map      Kind = "map"
+	Optional Kind = "optional"
+	Named    Kind = "named"
+)
+
+var primitives = map[string]Kind{
+	"bool": Bool,
+	"byte": Uint8,
+	"uint8": Uint8,
+	"int8": Int8,
+	"uint16": Uint16,
+	"int16": Int16,
+	"uint32": Uint32,
+	"int32": Int32,
+	"uint64": Uint64,
+	"int64": Int64,
+	"float32": Float32,
+	"float64": Float64,
+	"string": String,
+	"bytes": Bytes,
+	"varuint": VarUint,
+	"varint": VarInt,
+}
+
+// IsPrimitive reports whether the kind is not a composite type
+func (k Kind)IsPrimitive()(bool){
+	switch k {
+	case Slice, Array, Map, Optional, Named:
+		return false
+	}
+	return true
+}
+
+type Type struct{
+	Kind Kind `json:"kind"`
+	// Name is the referred struct or packet of a named type
+	Name string `json:"name,omitempty"`
+	// Len is the length of an array
+	Len int `json:"len,omitempty"`
+	Key *Type `json:"key,omitempty"`
+	Elem *Type `json:"elem,omitempty"`
+}
+
+func (t *Type)String()(string){
+	switch t.Kind {
+	case Slice:
+		return "[]" + t.Elem.String()
+	case Array:
+		return fmt.Sprintf("[%d]%s", t.Len, t.Elem)
+	case Map:
+		return "map[" + t.Key.String() + "]" + t.Elem.String()
+	case Optional:
+		return "?" + t.Elem.String()
+	case Named:
+		return t.Name
+	}
+	return (string)(t.Kind)
+}
+
+type Field struct{
+	Name string `json:"name"`
+	Type *Type `json:"type"`
+	Line int `json:"-"`
+}
+
+type Decl struct{
+	Name string `json:"name"`
+	// IsPacket reports whether the declaration is a packet or a plain struct
+	IsPacket bool `json:"packet"`
+	Id uint32 `json:"id,omitempty"`
+	// Response is the response packet name of an ask packet
+	Response string `json:"response,omitempty"`
+	Fields []*Field `json:"fields"`
+	Line int `json:"-"`
+}
+
+type File struct{
+	Package string `json:"package"`
+	Decls []*Decl `json:"decls"`
+}
+
+func (f *File)Lookup(name string)(*Decl){
+	for _, d := range f.Decls {
+		if d.Name == name {
+			return d
+		}
+	}
+	return nil
+}
+
+// GoName converts a schema identifier to an exported Go identifier, e.g. user_name to UserName
+func GoName(name string)(string){
+	var b strings.Builder
+	for _, part := range strings.Split(name, "_") {
+		if part == "" {
+			continue
+		}
+		b.WriteString(strings.ToUpper(part[:1]))
+		b.WriteString(part[1:])
+	}
+	return b.String()
+}
+
+// JSON returns the machine readable description of the schema, which is consumed by generators of other languages.
+// Every type is an object with a kind field, composite types refer their element by the elem (and key) fields,
+// and named types refer a declaration by the name field.
+func (f *File)JSON()([]byte, error){
+	return json.MarshalIndent(f, "", "\t")
+}
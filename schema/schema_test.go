@@ -0,0 +1,170 @@
+package schema_test
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kmcsr/go-pio/schema"
+)
+
+const demoSchema = `
+# demo schema
+package demo
+
+struct vec {
+	x float32
+	y float32
+}
+
+packet Move = 0x20 {
+	id varint
+	pos vec
+	path []vec
+	target ?vec
+	tags map[string]uint32
+	grid [2][2]int16
+	data bytes
+}
+
+packet GetUser = 0x21 -> User {
+	user_id uint64
+}
+
+packet User = 0x22 {
+	name string
+}
+`
+
+func TestParse(t *testing.T){
+	f, err := schema.Parse("demo.pio", ([]byte)(demoSchema))
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	if f.Package != "demo" || len(f.Decls) != 4 {
+		t.Fatalf("Unexpected file %+v", f)
+	}
+	move := f.Lookup("Move")
+	if move == nil || !move.IsPacket || move.Id != 0x20 || len(move.Fields) != 7 {
+		t.Fatalf("Unexpected Move %+v", move)
+	}
+	for i, want := range []string{"varint", "vec", "[]vec", "?vec", "map[string]uint32", "[2][2]int16", "bytes"} {
+		if got := move.Fields[i].Type.String(); got != want {
+			t.Errorf("Type of field %s is %s, expect %s", move.Fields[i].Name, got, want)
+		}
+	}
+	if ask := f.Lookup("GetUser"); ask.Response != "User" {
+		t.Errorf("Response of GetUser is %q", ask.Response)
+	}
+
+	src, err := f.GenerateGo("RegisterPackets")
+	if err != nil {
+		t.Fatalf("GenerateGo error: %v", err)
+	}
+	for _, want := range []string{"type Vec struct", "func (*Move) PktId() uint32 { return 0x20 }", "UserId uint64",
+		"func (p *GetUser) Ask() (pio.PacketBase, error)", "func RegisterPackets(c *pio.Conn)"} {
+		if !strings.Contains((string)(src), want) {
+			t.Errorf("Generated source does not contain %q", want)
+		}
+	}
+
+	desc, err := f.JSON()
+	if err != nil {
+		t.Fatalf("JSON error: %v", err)
+	}
+	var f2 schema.File
+	if err = json.Unmarshal(desc, &f2); err != nil {
+		t.Fatalf("Cannot decode the description: %v", err)
+	}
+	if got := f2.Lookup("Move").Fields[3].Type.String(); got != "?vec" {
+		t.Errorf("Decoded type is %s, expect ?vec", got)
+	}
+}
+
+func TestParseError(t *testing.T){
+	for _, src := range []string{
+		"struct A {}",
+		"package p\npacket A = 1 {}\npacket B = 1 {}",
+		"package p\nstruct A {}\nstruct A {}",
+		"package p\nstruct A { b B }",
+		"package p\nstruct A { m map[[]int32]int32 }",
+		"package p\nstruct A { x ??int32 }",
+		"package p\npacket A = 1 -> B {}\nstruct B {}",
+		"package p\nstruct A { x int32\nx int32 }",
+		"package p\nstruct A { x int32",
+		"package p\nstruct a {}\nstruct A {}",
+	}{
+		if _, err := schema.Parse("bad.pio", ([]byte)(src)); err == nil {
+			t.Errorf("Expect error for %q", src)
+		}else if _, ok := err.(*schema.SyntaxError); !ok {
+			t.Errorf("Unexpected error type %T", err)
+		}
+	}
+}
+
+// demoTest is compiled with the generated source of demoSchema
+const demoTest = `package demo
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kmcsr/go-pio/encoding"
+)
+
+func TestGenerated(t *testing.T){
+	HandleGetUser = func(p *GetUser)(*User, error){ return nil, nil }
+	if res, err := (&GetUser{UserId: 1}).Ask(); res != nil || err != nil {
+		t.Fatalf("Ask with a nil response returned %#v, %v", res, err)
+	}
+	m := &Move{Id: 3, Pos: Vec{1, 2}, Path: []Vec{{3, 4}}, Target: &Vec{5, 6}, Tags: map[string]uint32{"a": 1}, Data: []byte{7}}
+	var gen, ref bytes.Buffer
+	if err := m.WriteTo(encoding.WrapWriter(&gen)); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if err := encoding.Marshal(encoding.WrapWriter(&ref), m); err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if !bytes.Equal(gen.Bytes(), ref.Bytes()) {
+		t.Fatalf("WriteTo and Marshal are different:\n%x\n%x", gen.Bytes(), ref.Bytes())
+	}
+}
+`
+
+func TestGenerateGoCompile(t *testing.T){
+	if testing.Short() {
+		t.Skip("compiles the generated code")
+	}
+	f, err := schema.Parse("demo.pio", ([]byte)(demoSchema))
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	src, err := f.GenerateGo("RegisterPackets")
+	if err != nil {
+		t.Fatalf("GenerateGo error: %v", err)
+	}
+	root, err := filepath.Abs("..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	mod := "module demo\n\ngo 1.20\n\nrequire github.com/kmcsr/go-pio v0.0.0\n\nreplace github.com/kmcsr/go-pio => " + root + "\n"
+	for name, data := range map[string]string{
+		"go.mod": mod,
+		"demo_gen.go": (string)(src),
+		"demo_test.go": demoTest,
+	}{
+		if err = os.WriteFile(filepath.Join(dir, name), ([]byte)(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command("go", "test", "-count=1", ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOWORK=off", "GOFLAGS=-mod=mod")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go test of the generated code: %v\n%s", err, out)
+	}
+}
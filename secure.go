@@ -0,0 +1,292 @@
+package pio
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/kmcsr/go-pio/encoding"
+)
+
+// The handshake of an encrypted Conn.
+// Both sides write the hello message and read the hello of the peer at the same time:
+//
+//   [4]byte  magic "PIOE"
+//   byte     version, 0x01
+//   byte     mode, bit 0x01 for the static keys, bit 0x02 for the pre-shared key
+//   [32]byte X25519 ephemeral public key
+//
+// The input keying material is the X25519 shared secret of the ephemeral keys,
+// followed by the shared secret of the static keys in the static key mode.
+// HKDF-SHA256 with the pre-shared key as the salt,
+// and "pio secure v1" followed by the lower and then the higher ephemeral public key as the info,
+// derives 64 bytes, the first 32 bytes is the AES-256-GCM key of the side which has the lower ephemeral public key,
+// and the rest is the key of the other side.
+// The nonce is 4 zero bytes followed by the big endian uint64 count of the messages that the key has sealed.
+// Then both sides write the sealed "pio confirm" as a length prefixed message, and check the one of the peer.
+// After the handshake, every frame body is sealed, and the length prefix counts the 16 bytes tag.
+
+var (
+	ErrHandshake = errors.New("pio: secure handshake failed")
+	ErrDecrypt = errors.New("pio: cannot decrypt the frame")
+)
+
+const (
+	secureVersion byte = 0x01
+
+	secureModeStatic byte = 0x01
+	secureModePSK    byte = 0x02
+)
+
+var (
+	secureMagic = []byte("PIOE")
+	secureInfo = []byte("pio secure v1")
+	secureConfirm = []byte("pio confirm")
+)
+
+// SecureConfig configures the encryption of a Conn, the zero value uses only ephemeral keys,
+// which protects the connection from eavesdroppers but does not authenticate the peer
+type SecureConfig struct{
+	// StaticKey is the X25519 key of this side, and PeerKey is the pinned X25519 public key of the peer.
+	// If they are set, the handshake only succeeds with the peer that owns the private key of PeerKey
+	StaticKey *ecdh.PrivateKey
+	PeerKey *ecdh.PublicKey
+	// PreSharedKey is mixed into the session keys if it's not empty,
+	// the handshake only succeeds with the peer that has the same key
+	PreSharedKey []byte
+}
+
+func (cfg *SecureConfig)mode()(m byte){
+	if cfg.StaticKey != nil {
+		m |= secureModeStatic
+	}
+	if len(cfg.PreSharedKey) > 0 {
+		m |= secureModePSK
+	}
+	return
+}
+
+type secureState struct{
+	cfg *SecureConfig
+	sendAEAD, recvAEAD cipher.AEAD
+	sendSeq, recvSeq uint64
+	// binding is derived from the session keys, it's the same on both sides and unique to the session
+	binding []byte
+	// pending is the decrypted data that has not been read by the stream
+	pending []byte
+}
+
+func nonceOf(seq uint64)(nonce []byte){
+	nonce = make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return
+}
+
+// sealOverhead is the size of the GCM tag that seal appends
+const sealOverhead = 16
+
+func (s *secureState)seal(body []byte)([]byte){
+	out := s.sendAEAD.Seal(nil, nonceOf(s.sendSeq), body, nil)
+	s.sendSeq++
+	return out
+}
+
+func (s *secureState)open(frame []byte)(body []byte, err error){
+	if body, err = s.recvAEAD.Open(frame[:0], nonceOf(s.recvSeq), frame, nil); err != nil {
+		return nil, ErrDecrypt
+	}
+	s.recvSeq++
+	return
+}
+
+func hkdf(salt, ikm, info []byte, n int)(okm []byte){
+	ext := hmac.New(sha256.New, salt)
+	ext.Write(ikm)
+	prk := ext.Sum(nil)
+	var t []byte
+	for i := (byte)(1); len(okm) < n; i++ {
+		h := hmac.New(sha256.New, prk)
+		h.Write(t)
+		h.Write(info)
+		h.Write([]byte{i})
+		t = h.Sum(nil)
+		okm = append(okm, t...)
+	}
+	return okm[:n]
+}
+
+func newGCM(key []byte)(cipher.AEAD){
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+// exchange writes out while read runs, since the write may block until the peer reads.
+// It waits the write even if read failed, so the peer can receive the message and fail with the same reason
+func (c *Conn)exchange(out []byte, read func()(error))(err error){
+	werr := make(chan error, 1)
+	go func(){
+		_, err := c.w.Write(out)
+		werr <- err
+	}()
+	err = read()
+	if er := <-werr; err == nil {
+		err = er
+	}
+	return
+}
+
+// handshake runs the secure handshake, the authentication and the hello exchange if they are enabled,
+// it's called by Serve before any frame is sent or received
+func (c *Conn)handshake()(err error){
+	if c.secure != nil {
+		if err = c.secureHandshake(); err != nil {
+			return
+		}
+	}
+	if c.auth != nil {
+		if err = c.authenticate(); err != nil {
+			return
+		}
+	}
+	if c.info != nil {
+		if err = c.hello(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (c *Conn)hasHandshake()(bool){
+	return c.secure != nil || c.auth != nil || c.info != nil
+}
+
+// secureHandshake establishes the session keys
+func (c *Conn)secureHandshake()(err error){
+	cfg := c.secure.cfg
+	curve := ecdh.X25519()
+	var eph *ecdh.PrivateKey
+	if eph, err = curve.GenerateKey(rand.Reader); err != nil {
+		return
+	}
+	hello := make([]byte, 0, 38)
+	hello = append(hello, secureMagic...)
+	hello = append(hello, secureVersion, cfg.mode())
+	hello = append(hello, eph.PublicKey().Bytes()...)
+	peerHello := make([]byte, len(hello))
+	if err = c.exchange(hello, func()(err error){
+		_, err = io.ReadFull(c.r, peerHello)
+		return
+	}); err != nil {
+		return
+	}
+	if !bytes.Equal(peerHello[:4], secureMagic) || peerHello[4] != secureVersion {
+		return ErrHandshake
+	}
+	if peerHello[5] != cfg.mode() {
+		return ErrHandshake
+	}
+	var peerEph *ecdh.PublicKey
+	if peerEph, err = curve.NewPublicKey(peerHello[6:]); err != nil {
+		return ErrHandshake
+	}
+	var ikm []byte
+	if ikm, err = eph.ECDH(peerEph); err != nil {
+		return ErrHandshake
+	}
+	if cfg.StaticKey != nil {
+		var static []byte
+		if static, err = cfg.StaticKey.ECDH(cfg.PeerKey); err != nil {
+			return ErrHandshake
+		}
+		ikm = append(ikm, static...)
+	}
+	low, high := hello[6:], peerHello[6:]
+	lower := true
+	switch bytes.Compare(low, high) {
+	case 0:
+		return ErrHandshake
+	case 1:
+		low, high = high, low
+		lower = false
+	}
+	info := append(append(append([]byte{}, secureInfo...), low...), high...)
+	// the first 64 bytes are the keys, and the rest is the channel binding of the authentication
+	keys := hkdf(cfg.PreSharedKey, ikm, info, 96)
+	c.secure.binding = keys[64:]
+	if lower {
+		c.secure.sendAEAD, c.secure.recvAEAD = newGCM(keys[:32]), newGCM(keys[32:64])
+	}else{
+		c.secure.sendAEAD, c.secure.recvAEAD = newGCM(keys[32:64]), newGCM(keys[:32])
+	}
+
+	var confirm []byte
+	{
+		buf := new(bytes.Buffer)
+		w := encoding.WrapWriter(buf, c.encOpts...)
+		w.WriteBytes(c.secure.seal(secureConfirm))
+		confirm = buf.Bytes()
+	}
+	if err = c.exchange(confirm, func()(err error){
+		var frame []byte
+		if frame, err = c.readFrameMax((uint32)(len(secureConfirm) + sealOverhead)); err != nil {
+			return
+		}
+		if frame, err = c.secure.open(frame); err != nil || !bytes.Equal(frame, secureConfirm) {
+			return ErrHandshake
+		}
+		return
+	}); err != nil {
+		return
+	}
+	return nil
+}
+
+// secureChunk is the max size of the data that a sealed message of an encrypted stream carries
+const secureChunk = 16 * 1024
+
+func (c readWriteCloser)secureRead(buf []byte)(n int, err error){
+	s := c.c.secure
+	if len(s.pending) == 0 {
+		var frame []byte
+		if frame, err = c.c.readFrameMax(secureChunk + sealOverhead); err != nil {
+			return
+		}
+		if s.pending, err = s.open(frame); err != nil {
+			return
+		}
+	}
+	n = copy(buf, s.pending)
+	s.pending = s.pending[n:]
+	return
+}
+
+func (c readWriteCloser)secureWrite(buf []byte)(n int, err error){
+	c.c.wmux.Lock()
+	defer c.c.wmux.Unlock()
+	for len(buf) > 0 {
+		chunk := buf
+		if len(chunk) > secureChunk {
+			chunk = chunk[:secureChunk]
+		}
+		if err = c.c.w.WriteBytes(c.c.secure.seal(chunk)); err != nil {
+			return
+		}
+		n += len(chunk)
+		buf = buf[len(chunk):]
+	}
+	return
+}
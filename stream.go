@@ -0,0 +1,242 @@
+package pio
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+
+	"github.com/kmcsr/go-pio/encoding"
+)
+
+// StreamHead is the ask byte of the frame which starts a stream, the id of the frame is the stream id.
+// The content of the stream is sent by the stream chunk packets (0x12) which carry the stream id and the data,
+// and the stream end packet (0x13) which carries the stream id and an error message, which is empty if the stream is complete.
+// The receiver rejects a stream by an error packet (0x03) which ask byte is StreamHead and id is the stream id,
+// the chunks of a rejected stream are discarded
+const StreamHead byte = 0x03
+
+// DefaultMaxStreams is the max number of the streams that the peer can open at the same time if WithMaxStreams is not set
+const DefaultMaxStreams = 64
+
+// StreamChunkSize is the max size of the data in a stream chunk
+const StreamChunkSize = 32 * 1024
+
+// streamBacklog is the number of chunks that a stream buffers before the receiver reads them,
+// the Conn stops reading frames when the backlog is full
+const streamBacklog = 16
+
+// StreamPacket is a packet which is followed by a byte stream, see Conn.SendStream
+type StreamPacket interface{
+	PacketBase
+	// OnStream is called in a new goroutine after the packet is received, r reads the streamed bytes.
+	// The rest of the stream is discarded after OnStream returned
+	OnStream(r io.Reader)
+}
+
+type (
+	streamChunk struct{
+		Id uint32
+		Data []byte
+	}
+	streamEnd struct{
+		Id uint32
+		Err string
+	}
+)
+
+var _ PacketBase = (*streamChunk)(nil)
+var _ PacketBase = (*streamEnd)(nil)
+
+func (*streamChunk)PktId()(uint32){ return 0x12 }
+func (*streamEnd)PktId()(uint32){ return 0x13 }
+
+func (p *streamChunk)WriteTo(w encoding.Writer)(err error){
+	if err = w.WriteUint32(p.Id); err != nil {
+		return
+	}
+	return w.WriteBytes(p.Data)
+}
+
+func (p *streamChunk)ParseFrom(r encoding.Reader)(err error){
+	if p.Id, err = r.ReadUint32(); err != nil {
+		return
+	}
+	p.Data, err = encoding.ReadBytesView(r)
+	return
+}
+
+func (p *streamEnd)WriteTo(w encoding.Writer)(err error){
+	if err = w.WriteUint32(p.Id); err != nil {
+		return
+	}
+	return w.WriteString(p.Err)
+}
+
+func (p *streamEnd)ParseFrom(r encoding.Reader)(err error){
+	if p.Id, err = r.ReadUint32(); err != nil {
+		return
+	}
+	p.Err, err = r.ReadString()
+	return
+}
+
+// StreamError is returned by the stream reader when the sender aborted the stream
+type StreamError struct{
+	Msg string
+}
+
+func (e *StreamError)Error()(string){
+	return "pio: stream aborted by peer: " + e.Msg
+}
+
+// SendStream sends the packet, and then n bytes read from r in chunks.
+// Other packets can be sent between the chunks, so a large stream does not block the Conn.
+// If n is negative, r is read until EOF. The peer receives the bytes by the OnStream method of the packet.
+// If the peer rejected the stream, SendStream stops sending and returns the *RemoteError,
+// which matches ErrTooManyStreams if the peer has too many open streams.
+// The rejection which is received after the last chunk is sent is not reported
+func (c *Conn)SendStream(p PacketBase, r io.Reader, n int64)(err error){
+	c.checkStreamed()
+	id := atomic.AddUint32(&c.streamIns, 1)
+	rejected := make(chan error, 1)
+	c.idmux.Lock()
+	c.outStreams[id] = rejected
+	c.idmux.Unlock()
+	defer func(){
+		c.idmux.Lock()
+		delete(c.outStreams, id)
+		c.idmux.Unlock()
+	}()
+	if err = c.send(p, id, StreamHead); err != nil {
+		return
+	}
+	buf := make([]byte, StreamChunkSize)
+	for remain := n; n < 0 || remain > 0; {
+		select {
+		case err = <-rejected:
+			return
+		default:
+		}
+		chunk := buf
+		if n >= 0 && remain < (int64)(len(chunk)) {
+			chunk = chunk[:remain]
+		}
+		m, er := io.ReadFull(r, chunk)
+		if m > 0 {
+			if err = c.send(&streamChunk{Id: id, Data: chunk[:m]}, 0, NoAsk); err != nil {
+				return
+			}
+			remain -= (int64)(m)
+		}
+		if er != nil {
+			if er == io.EOF || er == io.ErrUnexpectedEOF {
+				if n < 0 {
+					break
+				}
+				er = io.ErrUnexpectedEOF
+			}
+			c.send(&streamEnd{Id: id, Err: er.Error()}, 0, NoAsk)
+			return er
+		}
+	}
+	return c.send(&streamEnd{Id: id}, 0, NoAsk)
+}
+
+type inStream struct{
+	ch chan []byte
+	// done is closed when the receiver returned
+	done chan struct{}
+	err error
+	buf []byte
+}
+
+func (s *inStream)Read(buf []byte)(n int, err error){
+	for len(s.buf) == 0 {
+		data, ok := <-s.ch
+		if !ok {
+			if s.err != nil {
+				return 0, s.err
+			}
+			return 0, io.EOF
+		}
+		s.buf = data
+	}
+	n = copy(buf, s.buf)
+	s.buf = s.buf[n:]
+	return
+}
+
+// openStream is called by the parser when a stream head is received,
+// it rejects the stream if the peer has opened too many streams
+func (c *Conn)openStream(id uint32, p PacketBase)(error){
+	s := &inStream{
+		ch: make(chan []byte, streamBacklog),
+		done: make(chan struct{}, 0),
+	}
+	if old, ok := c.streams[id]; ok {
+		delete(c.streams, id)
+		old.err = errors.New("pio: stream id reused")
+		close(old.ch)
+	}
+	if len(c.streams) >= c.maxStreams {
+		return c.send(errorPktOf(ErrTooManyStreams), id, StreamHead)
+	}
+	c.streams[id] = s
+	sp, ok := p.(StreamPacket)
+	if !ok {
+		close(s.done)
+		return nil
+	}
+	go func(){
+		defer close(s.done)
+		sp.OnStream(s)
+	}()
+	return nil
+}
+
+// onStreamRejected is called by the parser when the peer rejected the sending stream of the id
+func (c *Conn)onStreamRejected(id uint32, ep *errorPkt){
+	c.idmux.Lock()
+	ch, ok := c.outStreams[id]
+	c.idmux.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case ch <- &RemoteError{Code: ep.Code, Message: ep.Message, Details: ep.Details}:
+	default:
+	}
+}
+
+func (c *Conn)onStreamChunk(p *streamChunk){
+	s, ok := c.streams[p.Id]
+	if !ok {
+		return
+	}
+	select {
+	case s.ch <- p.Data:
+	case <-s.done:
+	case <-c.ctx.Done():
+	}
+}
+
+func (c *Conn)onStreamEnd(p *streamEnd){
+	s, ok := c.streams[p.Id]
+	if !ok {
+		return
+	}
+	delete(c.streams, p.Id)
+	if p.Err != "" {
+		s.err = &StreamError{p.Err}
+	}
+	close(s.ch)
+}
+
+// closeStreams ends the receiving streams when the Conn stops serving
+func (c *Conn)closeStreams(){
+	for id, s := range c.streams {
+		delete(c.streams, id)
+		s.err = io.ErrUnexpectedEOF
+		close(s.ch)
+	}
+}
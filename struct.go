@@ -0,0 +1,42 @@
+package pio
+
+import (
+	"github.com/kmcsr/go-pio/encoding"
+)
+
+type PktIder interface{
+	PktId()(uint32)
+}
+
+// StructPacket wraps a plain struct which has a PktId method into a PacketBase,
+// the fields are encoded by encoding.Marshal and encoding.Unmarshal
+type StructPacket[T PktIder] struct{
+	V T
+}
+
+var _ PacketBase = (*StructPacket[Ok])(nil)
+
+func NewStructPacket[T PktIder](v T)(*StructPacket[T]){
+	return &StructPacket[T]{
+		V: v,
+	}
+}
+
+// StructPacketNewer returns a PacketNewer that can be passed to Conn.AddPacket
+func StructPacketNewer[T PktIder]()(PacketNewer){
+	return func()(PacketBase){
+		return new(StructPacket[T])
+	}
+}
+
+func (p *StructPacket[T])PktId()(uint32){
+	return p.V.PktId()
+}
+
+func (p *StructPacket[T])ParseFrom(r encoding.Reader)(error){
+	return encoding.Unmarshal(r, &p.V)
+}
+
+func (p *StructPacket[T])WriteTo(w encoding.Writer)(error){
+	return encoding.Marshal(w, &p.V)
+}
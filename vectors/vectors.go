@@ -0,0 +1,417 @@
+// Package vectors defines the wire format of go-pio by golden test vectors.
+//
+// Every vector is the exact bytes produced by the encoding package or by pio.Conn for a value,
+// the vectors are also stored in the testdata directory as <name>.bin files together with vectors.json,
+// so implementations in other languages can check their encoders and decoders against them.
+//
+// The primitives are encoded as:
+//
+//	bool            1 byte, 0x00 for false and 0x01 for true (any non-zero byte is decoded as true)
+//	byte, int8      1 byte
+//	uint16, int16   2 bytes in the byte order of the encoding, signed integers use two's complement
+//	uint32, int32   4 bytes in the byte order
+//	uint64, int64   8 bytes in the byte order
+//	float32         the IEEE 754 bits as uint32
+//	float64         the IEEE 754 bits as uint64
+//	varuint         unsigned LEB128, 7 bits per byte with the least significant group first, at most 10 bytes
+//	varint          the zigzag encoded value ((v << 1) ^ (v >> 63)) as varuint
+//	length          uint32 in the byte order, or varuint if the encoding uses varint lengths
+//	string, bytes   length followed by the raw bytes
+//	bools           length followed by one bool per element
+//	uint16s ...     length (the element count) followed by the elements
+//
+// A frame, which Conn writes for every packet, is:
+//
+//	length          the size of the body
+//	body:
+//	  uint32 id     the ask id, 0 if the ask byte is 0x00
+//	  byte ask      0x00 for a plain packet, 0x01 for an ask, 0x02 for the reply of an ask,
+//	                0x03 for the head of a stream (see pio.StreamHead)
+//	  uint32 pkt id the packet id
+//	  payload       the fields written by the WriteTo method of the packet
+//
+// If the Conns use compression (pio.WithCompression), the high bit (0x80) of the ask byte marks
+// a compressed frame, only the payload is compressed.
+// If the Conns use a checksum (pio.WithChecksum), the checksum of the body follows the body,
+// and the length counts it too.
+// If the Conns use encryption (pio.WithEncryption), the body with the checksum is sealed after the handshake,
+// see the handshake description in secure.go of package pio.
+//
+// The reply of an ask uses the same id as the ask. The built-in packets are
+// Ping (0x01, uint64 payload), Pong (0x02, uint64 payload, the reply of Ping with the same payload),
+// Ok (0x04, empty, the reply of an ask without a response packet),
+// Error (0x03, uint32 code, string message and bytes details, the reply of an ask which failed),
+// and the stream switch packets 0x10 (stream ping) and 0x11 (stream pong) without payload.
+// After a peer receives a stream ping it replies a stream pong, then both sides stop reading frames
+// and the connection becomes a raw byte stream.
+//
+// In vectors.json the integers and floats are decimal strings, so 64-bit values keep their precision
+// ("+Inf" and "-Inf" for infinities), strings are JSON strings, and bytes are hex strings.
+package vectors
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/kmcsr/go-pio"
+	"github.com/kmcsr/go-pio/encoding"
+)
+
+//go:generate go run ../cmd/piovectors -o testdata
+
+// Encoding is the encoding options that a vector is produced with
+type Encoding struct{
+	// ByteOrder is "little" or "big"
+	ByteOrder string `json:"byte_order"`
+	VarintLength bool `json:"varint_length"`
+}
+
+// Encodings are the encodings that the vectors are produced with, keyed by the directory names of the vectors
+var Encodings = []struct{
+	Name string
+	Encoding
+}{
+	{"le", Encoding{"little", false}},
+	{"be", Encoding{"big", false}},
+	{"le-varlen", Encoding{"little", true}},
+}
+
+// Options returns the encoding options of e
+func (e Encoding)Options()(opts []encoding.Option){
+	if e.ByteOrder == "big" {
+		opts = append(opts, encoding.WithByteOrder(binary.BigEndian))
+	}
+	if e.VarintLength {
+		opts = append(opts, encoding.WithVarintLength())
+	}
+	return
+}
+
+// Frame is the header of a frame vector
+type Frame struct{
+	Id uint32 `json:"id"`
+	Ask byte `json:"ask"`
+	PktId uint32 `json:"pkt_id"`
+	// Packet is the name of the packet, e.g. "Ping"
+	Packet string `json:"packet"`
+	// Payload is the hex encoded payload of the packet
+	Payload string `json:"payload"`
+}
+
+type Vector struct{
+	// Name is unique and is the path of the binary file without the .bin extension
+	Name string `json:"name"`
+	Encoding Encoding `json:"encoding"`
+	// Type is the encoding primitive, e.g. "uint16" or "varint", or "frame"
+	Type string `json:"type"`
+	// Value is the encoded value, or the fields of the packet for a frame
+	Value any `json:"value"`
+	Frame *Frame `json:"frame,omitempty"`
+	// Hex is the hex encoded Data
+	Hex string `json:"hex"`
+	Data []byte `json:"-"`
+}
+
+// File is the content of vectors.json
+type File struct{
+	Version int `json:"version"`
+	Vectors []*Vector `json:"vectors"`
+}
+
+const Version = 1
+
+type (
+	varUint uint64
+	varInt int64
+	length uint32
+)
+
+type primitive struct{
+	typ string
+	values []any
+}
+
+var primitives = []primitive{
+	{"bool", []any{false, true}},
+	{"byte", []any{(byte)(0), (byte)(0x7f), (byte)(0xff)}},
+	{"uint16", []any{(uint16)(0), (uint16)(0x1234), (uint16)(math.MaxUint16)}},
+	{"uint32", []any{(uint32)(0), (uint32)(0x12345678), (uint32)(math.MaxUint32)}},
+	{"uint64", []any{(uint64)(0), (uint64)(0x0123456789abcdef), (uint64)(math.MaxUint64)}},
+	{"int8", []any{(int8)(0), (int8)(-1), (int8)(math.MinInt8), (int8)(math.MaxInt8)}},
+	{"int16", []any{(int16)(-2), (int16)(math.MinInt16), (int16)(math.MaxInt16)}},
+	{"int32", []any{(int32)(-2), (int32)(math.MinInt32), (int32)(math.MaxInt32)}},
+	{"int64", []any{(int64)(-2), (int64)(math.MinInt64), (int64)(math.MaxInt64)}},
+	{"float32", []any{(float32)(0), (float32)(math.Copysign(0, -1)), (float32)(1.5), (float32)(-3.14),
+		(float32)(math.SmallestNonzeroFloat32), (float32)(math.Inf(1)), (float32)(math.Inf(-1))}},
+	{"float64", []any{(float64)(0), math.Copysign(0, -1), 1.5, -3.14,
+		math.SmallestNonzeroFloat64, math.MaxFloat64, math.Inf(1), math.Inf(-1)}},
+	{"varuint", []any{(varUint)(0), (varUint)(1), (varUint)(127), (varUint)(128), (varUint)(300),
+		(varUint)(1 << 63), (varUint)(math.MaxUint64)}},
+	{"varint", []any{(varInt)(0), (varInt)(-1), (varInt)(1), (varInt)(-64), (varInt)(63), (varInt)(64),
+		(varInt)(math.MinInt64), (varInt)(math.MaxInt64)}},
+	{"length", []any{(length)(0), (length)(1), (length)(300), (length)(math.MaxUint32)}},
+	{"string", []any{"", "pio", "héllo, 世界"}},
+	{"bytes", []any{[]byte{}, []byte{0x00, 0x01, 0xff}}},
+	{"bools", []any{[]bool{}, []bool{true, false, true}}},
+	{"uint16s", []any{[]uint16{1, math.MaxUint16}}},
+	{"uint32s", []any{[]uint32{1, math.MaxUint32}}},
+	{"uint64s", []any{[]uint64{1, math.MaxUint64}}},
+	{"int8s", []any{[]int8{-1, math.MaxInt8}}},
+	{"int16s", []any{[]int16{-1, math.MaxInt16}}},
+	{"int32s", []any{[]int32{-1, math.MaxInt32}}},
+	{"int64s", []any{[]int64{-1, math.MaxInt64}}},
+	{"float32s", []any{[]float32{1.5, -2}}},
+	{"float64s", []any{[]float64{1.5, -2}}},
+}
+
+func writeValue(w encoding.Writer, v any)(error){
+	switch v := v.(type) {
+	case bool:
+		return w.WriteBool(v)
+	case byte:
+		return w.WriteByte(v)
+	case uint16:
+		return w.WriteUint16(v)
+	case uint32:
+		return w.WriteUint32(v)
+	case uint64:
+		return w.WriteUint64(v)
+	case int8:
+		return w.WriteInt8(v)
+	case int16:
+		return w.WriteInt16(v)
+	case int32:
+		return w.WriteInt32(v)
+	case int64:
+		return w.WriteInt64(v)
+	case float32:
+		return w.WriteFloat32(v)
+	case float64:
+		return w.WriteFloat64(v)
+	case varUint:
+		return w.WriteVarUint((uint64)(v))
+	case varInt:
+		return w.WriteVarInt((int64)(v))
+	case length:
+		return w.WriteLength((uint32)(v))
+	case string:
+		return w.WriteString(v)
+	case []byte:
+		return w.WriteBytes(v)
+	case []bool:
+		return w.WriteBools(v)
+	case []uint16:
+		return w.WriteUint16s(v)
+	case []uint32:
+		return w.WriteUint32s(v)
+	case []uint64:
+		return w.WriteUint64s(v)
+	case []int8:
+		return w.WriteInt8s(v)
+	case []int16:
+		return w.WriteInt16s(v)
+	case []int32:
+		return w.WriteInt32s(v)
+	case []int64:
+		return w.WriteInt64s(v)
+	case []float32:
+		return w.WriteFloat32s(v)
+	case []float64:
+		return w.WriteFloat64s(v)
+	}
+	panic("vectors: unexpected value type")
+}
+
+// jsonValue converts v to the representation in vectors.json
+func jsonValue(v any)(any){
+	switch v := v.(type) {
+	case bool, string:
+		return v
+	case byte:
+		return strconv.FormatUint((uint64)(v), 10)
+	case uint16:
+		return strconv.FormatUint((uint64)(v), 10)
+	case uint32:
+		return strconv.FormatUint((uint64)(v), 10)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case varUint:
+		return strconv.FormatUint((uint64)(v), 10)
+	case length:
+		return strconv.FormatUint((uint64)(v), 10)
+	case int8:
+		return strconv.FormatInt((int64)(v), 10)
+	case int16:
+		return strconv.FormatInt((int64)(v), 10)
+	case int32:
+		return strconv.FormatInt((int64)(v), 10)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case varInt:
+		return strconv.FormatInt((int64)(v), 10)
+	case float32:
+		return strconv.FormatFloat((float64)(v), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case []byte:
+		return hex.EncodeToString(v)
+	case []bool:
+		return v
+	case []uint16:
+		return jsonSlice(v)
+	case []uint32:
+		return jsonSlice(v)
+	case []uint64:
+		return jsonSlice(v)
+	case []int8:
+		return jsonSlice(v)
+	case []int16:
+		return jsonSlice(v)
+	case []int32:
+		return jsonSlice(v)
+	case []int64:
+		return jsonSlice(v)
+	case []float32:
+		return jsonSlice(v)
+	case []float64:
+		return jsonSlice(v)
+	}
+	panic("vectors: unexpected value type")
+}
+
+func jsonSlice[T any](v []T)(s []any){
+	s = make([]any, len(v))
+	for i, e := range v {
+		s[i] = jsonValue(e)
+	}
+	return
+}
+
+type frameSample struct{
+	name string
+	id uint32
+	ask byte
+	pktId uint32
+	packet string
+	payload *uint64
+}
+
+func ptr[T any](v T)(*T){ return &v }
+
+var frames = []frameSample{
+	{"ping.0", 1, pio.SendAsk, 0x01, "Ping", ptr[uint64](0)},
+	{"pong.0", 1, pio.RecvAsk, 0x02, "Pong", ptr[uint64](0)},
+	{"ping.1", 0xfffffffe, pio.SendAsk, 0x01, "Ping", ptr[uint64](0x0123456789abcdef)},
+	{"pong.1", 0xfffffffe, pio.RecvAsk, 0x02, "Pong", ptr[uint64](0x0123456789abcdef)},
+	{"ok", 3, pio.RecvAsk, 0x04, "Ok", nil},
+	{"stream-ping", 0, pio.NoAsk, 0x10, "StreamPing", nil},
+	{"stream-pong", 0, pio.NoAsk, 0x11, "StreamPong", nil},
+}
+
+// EncodeFrame returns the frame with the header and the payload, exactly as Conn writes it
+func EncodeFrame(enc Encoding, id uint32, ask byte, pktId uint32, payload []byte)([]byte){
+	body := new(bytes.Buffer)
+	w := encoding.WrapWriter(body, enc.Options()...)
+	w.WriteUint32(id)
+	w.WriteByte(ask)
+	w.WriteUint32(pktId)
+	w.Write(payload)
+	frame := new(bytes.Buffer)
+	encoding.WrapWriter(frame, enc.Options()...).WriteBytes(body.Bytes())
+	return frame.Bytes()
+}
+
+func newVector(name string, enc Encoding, typ string, value any, frame *Frame, data []byte)(*Vector){
+	return &Vector{
+		Name: name,
+		Encoding: enc,
+		Type: typ,
+		Value: value,
+		Frame: frame,
+		Hex: hex.EncodeToString(data),
+		Data: data,
+	}
+}
+
+// All returns all vectors, in the same order as vectors.json
+func All()(vs []*Vector){
+	for _, e := range Encodings {
+		for _, p := range primitives {
+			for i, v := range p.values {
+				buf := new(bytes.Buffer)
+				if err := writeValue(encoding.WrapWriter(buf, e.Options()...), v); err != nil {
+					panic(err)
+				}
+				vs = append(vs, newVector(e.Name + "/" + p.typ + "." + strconv.Itoa(i), e.Encoding, p.typ, jsonValue(v), nil, buf.Bytes()))
+			}
+		}
+		for _, f := range frames {
+			var (
+				payload []byte
+				value any
+			)
+			if f.payload != nil {
+				buf := new(bytes.Buffer)
+				encoding.WrapWriter(buf, e.Options()...).WriteUint64(*f.payload)
+				payload = buf.Bytes()
+				value = map[string]any{"payload": jsonValue(*f.payload)}
+			}
+			frame := &Frame{
+				Id: f.id,
+				Ask: f.ask,
+				PktId: f.pktId,
+				Packet: f.packet,
+				Payload: hex.EncodeToString(payload),
+			}
+			vs = append(vs, newVector(e.Name + "/frame." + f.name, e.Encoding, "frame", value, frame,
+				EncodeFrame(e.Encoding, f.id, f.ask, f.pktId, payload)))
+		}
+	}
+	return
+}
+
+// Lookup returns the vector with the name, or nil if it's not exists
+func Lookup(name string)(*Vector){
+	for _, v := range All() {
+		if v.Name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+// JSON returns the content of vectors.json
+func JSON()([]byte, error){
+	buf, err := json.MarshalIndent(&File{
+		Version: Version,
+		Vectors: All(),
+	}, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, '\n'), nil
+}
+
+// WriteFiles writes vectors.json and the binary file of every vector into the directory
+func WriteFiles(dir string)(err error){
+	for _, v := range All() {
+		name := filepath.Join(dir, filepath.FromSlash(v.Name) + ".bin")
+		if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return
+		}
+		if err = os.WriteFile(name, v.Data, 0644); err != nil {
+			return
+		}
+	}
+	var buf []byte
+	if buf, err = JSON(); err != nil {
+		return
+	}
+	return os.WriteFile(filepath.Join(dir, "vectors.json"), buf, 0644)
+}
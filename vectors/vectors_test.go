@@ -0,0 +1,95 @@
+package vectors_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kmcsr/go-pio"
+	. "github.com/kmcsr/go-pio/vectors"
+)
+
+func TestGolden(t *testing.T){
+	for _, v := range All() {
+		data, err := os.ReadFile(filepath.Join("testdata", filepath.FromSlash(v.Name) + ".bin"))
+		if err != nil {
+			t.Fatalf("Cannot read golden file of %s: %v, run go generate to update the vectors", v.Name, err)
+		}
+		if !bytes.Equal(data, v.Data) {
+			t.Errorf("Vector %s is %x, but golden file is %x", v.Name, v.Data, data)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join("testdata", "vectors.json"))
+	if err != nil {
+		t.Fatalf("Cannot read vectors.json: %v", err)
+	}
+	desc, err := JSON()
+	if err != nil {
+		t.Fatalf("JSON error: %v", err)
+	}
+	if !bytes.Equal(data, desc) {
+		t.Errorf("vectors.json is outdated, run go generate to update the vectors")
+	}
+}
+
+func TestFrameLayout(t *testing.T){
+	for name, want := range map[string]string{
+		"le/frame.ping.1": "11000000" + "feffffff" + "01" + "01000000" + "efcdab8967452301",
+		"be/frame.pong.1": "00000011" + "fffffffe" + "02" + "00000002" + "0123456789abcdef",
+		"le-varlen/frame.ok": "09" + "03000000" + "02" + "04000000",
+		"le/varint.1": "01",
+		"le-varlen/string.1": "03" + "70696f",
+	}{
+		v := Lookup(name)
+		if v == nil {
+			t.Fatalf("Vector %s not found", name)
+		}
+		if v.Hex != want {
+			t.Errorf("Vector %s is %s, expect %s", name, v.Hex, want)
+		}
+	}
+}
+
+type pipeRW struct{
+	io.Reader
+	io.Writer
+}
+
+func TestVerifyConn(t *testing.T){
+	for _, e := range Encodings {
+		t.Run(e.Name, func(t *testing.T){
+			ar, bw := io.Pipe()
+			br, aw := io.Pipe()
+			c := pio.NewConn(br, bw, pio.WithEncoding(e.Options()...))
+			defer c.Close()
+			go c.Serve()
+			go func(){
+				<-c.StreamedDone()
+				rw, err := c.AsStream()
+				if err != nil {
+					return
+				}
+				io.Copy(rw, rw)
+			}()
+			if err := Verify(pipeRW{ar, aw}, e.Encoding); err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyMismatch(t *testing.T){
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+	go func(){
+		buf := make([]byte, len(Lookup("le/frame.ping.0").Data))
+		io.ReadFull(br, buf)
+		bw.Write(Lookup("le/frame.ok").Data)
+	}()
+	err := Verify(pipeRW{ar, aw}, Encodings[0].Encoding)
+	if me, ok := err.(*MismatchError); !ok || me.Vector != "le/frame.pong.0" {
+		t.Fatalf("Expect MismatchError of le/frame.pong.0, got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package vectors
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/kmcsr/go-pio/encoding"
+)
+
+// MaxVerifyFrame is the max frame size that Verify accepts from the peer
+const MaxVerifyFrame = 1 << 20
+
+// StreamProbe is the data that Verify writes after the stream switch, the peer must echo it back
+var StreamProbe = ([]byte)("pio vectors stream probe\n")
+
+// MismatchError is returned by Verify when the peer did not reply the expected frame
+type MismatchError struct{
+	// Vector is the name of the expected vector
+	Vector string
+	Got, Want []byte
+}
+
+func (e *MismatchError)Error()(string){
+	return fmt.Sprintf("vectors: peer replied %s, expect %s (%s)", hex.EncodeToString(e.Got), hex.EncodeToString(e.Want), e.Vector)
+}
+
+// Verify checks the pio implementation on the other side of rw with the frame vectors of the encoding.
+// It sends the ping frames and expects the exact pong frames, then sends the stream ping and expects the stream pong.
+// After the stream switch the peer must echo everything it reads, Verify checks the echo of StreamProbe.
+func Verify(rw io.ReadWriter, enc Encoding)(err error){
+	var name string
+	for _, e := range Encodings {
+		if e.Encoding == enc {
+			name = e.Name
+			break
+		}
+	}
+	if name == "" {
+		return fmt.Errorf("vectors: no vectors for encoding %+v", enc)
+	}
+	raw := new(bytes.Buffer)
+	r := encoding.WrapReader(io.TeeReader(rw, raw), enc.Options()...)
+	exchange := func(send, expect string)(err error){
+		req, res := Lookup(name + "/" + send), Lookup(name + "/" + expect)
+		if _, err = rw.Write(req.Data); err != nil {
+			return fmt.Errorf("vectors: write %s: %w", req.Name, err)
+		}
+		raw.Reset()
+		var l uint32
+		if l, err = r.ReadLength(); err != nil {
+			return fmt.Errorf("vectors: read reply of %s: %w", req.Name, err)
+		}
+		if l > MaxVerifyFrame {
+			return &MismatchError{res.Name, raw.Bytes(), res.Data}
+		}
+		if _, err = io.ReadFull(r, make([]byte, l)); err != nil {
+			return fmt.Errorf("vectors: read reply of %s: %w", req.Name, err)
+		}
+		if !bytes.Equal(raw.Bytes(), res.Data) {
+			return &MismatchError{res.Name, raw.Bytes(), res.Data}
+		}
+		return nil
+	}
+	if err = exchange("frame.ping.0", "frame.pong.0"); err != nil {
+		return
+	}
+	if err = exchange("frame.ping.1", "frame.pong.1"); err != nil {
+		return
+	}
+	if err = exchange("frame.stream-ping", "frame.stream-pong"); err != nil {
+		return
+	}
+	if _, err = rw.Write(StreamProbe); err != nil {
+		return fmt.Errorf("vectors: write stream probe: %w", err)
+	}
+	echo := make([]byte, len(StreamProbe))
+	if _, err = io.ReadFull(rw, echo); err != nil {
+		return fmt.Errorf("vectors: read stream echo: %w", err)
+	}
+	if !bytes.Equal(echo, StreamProbe) {
+		return &MismatchError{"stream echo", echo, StreamProbe}
+	}
+	return nil
+}
+